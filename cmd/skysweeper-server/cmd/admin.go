@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/models"
+	"github.com/pojntfx/skysweeper/pkg/persisters"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	outputFlag = "output"
+
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+var (
+	errUnsupportedOutput = errors.New("unsupported output format")
+)
+
+// AdminConfiguration is a configuration as shown to operators; the refresh token is never included
+type AdminConfiguration struct {
+	DID               string `json:"did"`
+	Service           string `json:"service"`
+	Enabled           bool   `json:"enabled"`
+	DisabledByFailure bool   `json:"disabledByFailure"`
+	PostTTL           int32  `json:"postTTL"`
+	Cursor            string `json:"cursor"`
+
+	PointsSpent    int64      `json:"pointsSpent"`
+	BacklogPending bool       `json:"backlogPending"`
+	PostsPending   int64      `json:"postsPending"`
+	LastSweptPosts int64      `json:"lastSweptPosts"`
+	LastSweptAt    *time.Time `json:"lastSweptAt"`
+}
+
+func newAdminConfiguration(c models.Configuration) AdminConfiguration {
+	var lastSweptAt *time.Time
+	if c.LastSweptAt.Valid {
+		lastSweptAt = &c.LastSweptAt.Time
+	}
+
+	return AdminConfiguration{
+		DID:               c.Did,
+		Service:           c.Service,
+		Enabled:           c.Enabled,
+		DisabledByFailure: c.DisabledByFailure,
+		PostTTL:           c.PostTtl,
+		Cursor:            c.Cursor,
+
+		PointsSpent:    c.PointsSpent,
+		BacklogPending: c.BacklogPending,
+		PostsPending:   c.PostsPending,
+		LastSweptPosts: c.LastSweptPosts,
+		LastSweptAt:    lastSweptAt,
+	}
+}
+
+type AdminStats struct {
+	Total             int64 `json:"total"`
+	Enabled           int64 `json:"enabled"`
+	Disabled          int64 `json:"disabled"`
+	DisabledByFailure int64 `json:"disabledByFailure"`
+}
+
+// writeOutput writes v as JSON or, using writeTable, as a table to w depending on format
+func writeOutput(w io.Writer, format string, v any, writeTable func(w *tabwriter.Writer)) error {
+	switch format {
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+		writeTable(tw)
+
+		return tw.Flush()
+
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(v)
+
+	default:
+		return fmt.Errorf("%w: %v", errUnsupportedOutput, format)
+	}
+}
+
+func writeConfigurations(w io.Writer, format string, configurations []AdminConfiguration) error {
+	return writeOutput(w, format, configurations, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "DID\tSERVICE\tENABLED\tDISABLED BY FAILURE\tPOST TTL\tCURSOR\tPOINTS SPENT\tBACKLOG PENDING\tPOSTS PENDING\tLAST SWEPT AT")
+
+		for _, c := range configurations {
+			lastSweptAt := "never"
+			if c.LastSweptAt != nil {
+				lastSweptAt = c.LastSweptAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", c.DID, c.Service, c.Enabled, c.DisabledByFailure, c.PostTTL, c.Cursor, c.PointsSpent, c.BacklogPending, c.PostsPending, lastSweptAt)
+		}
+	})
+}
+
+func writeConfiguration(w io.Writer, format string, configuration AdminConfiguration) error {
+	if format == outputJSON {
+		return writeOutput(w, format, configuration, nil)
+	}
+
+	return writeConfigurations(w, format, []AdminConfiguration{configuration})
+}
+
+// runAdmin opens an admin persister for the duration of fn
+func runAdmin(cmd *cobra.Command, fn func(ctx context.Context, persister *persisters.AdminPersister) error) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	persister := persisters.NewAdminPersister(viper.GetString(databaseURLFlag))
+
+	if err := persister.Open(); err != nil {
+		return err
+	}
+	defer persister.Close()
+
+	return fn(cmd.Context(), persister)
+}
+
+// checkConfigurationFound converts a missing row into errConfigurationNotFound
+func checkConfigurationFound(did string, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %v", errConfigurationNotFound, did)
+	}
+
+	return err
+}
+
+var adminCmd = &cobra.Command{
+	Use:     "admin",
+	Aliases: []string{"a"},
+	Short:   "Inspect and fix SkySweeper configurations",
+}
+
+var adminListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List all configurations",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAdmin(cmd, func(ctx context.Context, persister *persisters.AdminPersister) error {
+			rows, err := persister.GetConfigurations(ctx)
+			if err != nil {
+				return err
+			}
+
+			configurations := []AdminConfiguration{}
+			for _, row := range rows {
+				configurations = append(configurations, newAdminConfiguration(row))
+			}
+
+			return writeConfigurations(os.Stdout, viper.GetString(outputFlag), configurations)
+		})
+	},
+}
+
+var adminShowCmd = &cobra.Command{
+	Use:   "show <did>",
+	Short: "Show a configuration",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAdmin(cmd, func(ctx context.Context, persister *persisters.AdminPersister) error {
+			c, err := persister.GetConfiguration(ctx, args[0])
+			if err != nil {
+				return checkConfigurationFound(args[0], err)
+			}
+
+			return writeConfiguration(os.Stdout, viper.GetString(outputFlag), newAdminConfiguration(c))
+		})
+	},
+}
+
+func newAdminSetEnabledCmd(use string, short string, enabled bool) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " <did>",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdmin(cmd, func(ctx context.Context, persister *persisters.AdminPersister) error {
+				c, err := persister.SetConfigurationEnabled(ctx, args[0], enabled)
+				if err != nil {
+					return checkConfigurationFound(args[0], err)
+				}
+
+				return writeConfiguration(os.Stdout, viper.GetString(outputFlag), newAdminConfiguration(c))
+			})
+		},
+	}
+}
+
+var adminResetCursorCmd = &cobra.Command{
+	Use:   "reset-cursor <did>",
+	Short: "Reset the cursor of a configuration, which makes the next sweep rescan all posts",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAdmin(cmd, func(ctx context.Context, persister *persisters.AdminPersister) error {
+			c, err := persister.ResetConfigurationCursor(ctx, args[0])
+			if err != nil {
+				return checkConfigurationFound(args[0], err)
+			}
+
+			return writeConfiguration(os.Stdout, viper.GetString(outputFlag), newAdminConfiguration(c))
+		})
+	},
+}
+
+var adminDeleteCmd = &cobra.Command{
+	Use:     "delete <did>",
+	Aliases: []string{"rm"},
+	Short:   "Delete a configuration, including its refresh token",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAdmin(cmd, func(ctx context.Context, persister *persisters.AdminPersister) error {
+			c, err := persister.GetConfiguration(ctx, args[0])
+			if err != nil {
+				return checkConfigurationFound(args[0], err)
+			}
+
+			if err := persister.DeleteConfiguration(ctx, args[0]); err != nil {
+				return err
+			}
+
+			// Show what has been deleted so that it can be recreated if needed
+			return writeConfiguration(os.Stdout, viper.GetString(outputFlag), newAdminConfiguration(c))
+		})
+	},
+}
+
+var adminStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show configuration statistics",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAdmin(cmd, func(ctx context.Context, persister *persisters.AdminPersister) error {
+			counts, err := persister.CountConfigurations(ctx)
+			if err != nil {
+				return err
+			}
+
+			stats := AdminStats{
+				Total:             counts.Total,
+				Enabled:           counts.Enabled,
+				Disabled:          counts.Total - counts.Enabled,
+				DisabledByFailure: counts.DisabledByFailure,
+			}
+
+			return writeOutput(os.Stdout, viper.GetString(outputFlag), stats, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "TOTAL\tENABLED\tDISABLED\tDISABLED BY FAILURE")
+				fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", stats.Total, stats.Enabled, stats.Disabled, stats.DisabledByFailure)
+			})
+		})
+	},
+}
+
+func init() {
+	adminCmd.PersistentFlags().StringP(outputFlag, "o", outputTable, "Output format (table or json)")
+
+	adminCmd.AddCommand(
+		adminListCmd,
+		adminShowCmd,
+		newAdminSetEnabledCmd("enable", "Enable a configuration", true),
+		newAdminSetEnabledCmd("disable", "Disable a configuration", false),
+		adminResetCursorCmd,
+		adminDeleteCmd,
+		adminStatsCmd,
+	)
+
+	viper.AutomaticEnv()
+
+	rootCmd.AddCommand(adminCmd)
+}
@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+	"github.com/pojntfx/skysweeper/pkg/metrics"
+	"github.com/pojntfx/skysweeper/pkg/models"
+	"github.com/pojntfx/skysweeper/pkg/problems"
+	"github.com/spf13/viper"
+)
+
+const (
+	adminTokenFlag = "admin-token"
+
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 1000
+)
+
+var (
+	errInvalidAdminToken     = errors.New("invalid admin token")
+	errAdminTokenIsAPIKey    = errors.New("admin token must differ from the API key")
+	errInvalidPageSize       = fmt.Errorf("invalid limit, must be between 1 and %v", maxAdminPageSize)
+	errConfigurationDisabled = errors.New("configuration is disabled")
+	errRunNotFound           = errors.New("run not found")
+	errAdminNotFound         = errors.New("not found")
+
+	errCouldNotGetConfigurations   = errors.New("could not get configurations")
+	errCouldNotUpdateConfiguration = errors.New("could not update configuration")
+	errCouldNotCountConfigurations = errors.New("could not count configurations")
+)
+
+// AdminConfigurationsPage is a page of configurations; pass Next as `after` to get the next page
+type AdminConfigurationsPage struct {
+	Configurations []AdminConfiguration `json:"configurations"`
+	Next           string               `json:"next,omitempty"`
+}
+
+// adminPersister is the subset of `persisters.AdminPersister` needed by the admin API
+type adminPersister interface {
+	GetConfigurationsPage(ctx context.Context, after string, limit int32) ([]models.Configuration, error)
+	GetConfiguration(ctx context.Context, did string) (models.Configuration, error)
+	SetConfigurationEnabled(ctx context.Context, did string, enabled bool) (models.Configuration, error)
+	DeleteConfiguration(ctx context.Context, did string) error
+	CountConfigurations(ctx context.Context) (models.CountConfigurationsRow, error)
+}
+
+func checkAdminToken(r *http.Request) error {
+	requestAdminToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.TrimSpace(requestAdminToken) == "" {
+		return problems.Unauthorized(errMissingAuthorization)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(requestAdminToken), []byte(viper.GetString(adminTokenFlag))) != 1 {
+		return problems.Unauthorized(errInvalidAdminToken)
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return fmt.Errorf("%w: %v", errCouldNotEncode, err)
+	}
+
+	return nil
+}
+
+// registerAdminHandlers adds the admin API to mux below `/admin/`
+func registerAdminHandlers(
+	ctx context.Context,
+
+	mux *http.ServeMux,
+
+	persister adminPersister,
+
+	runner *jobs.Runner,
+	newDIDSweep sweepFactory,
+) {
+	mux.Handle("/admin/", metrics.InstrumentHandler("admin", problems.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if err := checkAdminToken(r); err != nil {
+			return err
+		}
+
+		resource, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/"), "/")
+
+		switch resource {
+		case "configurations":
+			if rest == "" {
+				return handleAdminConfigurations(w, r, persister)
+			}
+
+			did, action, _ := strings.Cut(rest, "/")
+
+			return handleAdminConfiguration(ctx, w, r, persister, runner, newDIDSweep, did, action)
+
+		case "runs":
+			return handleAdminRuns(w, r, runner, rest)
+
+		case "stats":
+			if rest != "" {
+				return problems.NotFound(errAdminNotFound)
+			}
+
+			return handleAdminStats(w, r, persister)
+
+		default:
+			return problems.NotFound(errAdminNotFound)
+		}
+	})))
+}
+
+func handleAdminConfigurations(w http.ResponseWriter, r *http.Request, persister adminPersister) error {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+
+		return problems.MethodNotAllowed(r.Method)
+	}
+
+	limit := defaultAdminPageSize
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > maxAdminPageSize {
+			return problems.BadRequest(errInvalidPageSize)
+		}
+	}
+
+	// Get one more configuration than requested to know whether there is a next page
+	rows, err := persister.GetConfigurationsPage(r.Context(), r.URL.Query().Get("after"), int32(limit+1))
+	if err != nil {
+		return problems.Database(errCouldNotGetConfigurations, err)
+	}
+
+	page := AdminConfigurationsPage{
+		Configurations: []AdminConfiguration{},
+	}
+
+	for i, row := range rows {
+		if i == limit {
+			page.Next = rows[i-1].Did
+
+			break
+		}
+
+		page.Configurations = append(page.Configurations, newAdminConfiguration(row))
+	}
+
+	return writeJSON(w, http.StatusOK, page)
+}
+
+func handleAdminConfiguration(
+	ctx context.Context,
+
+	w http.ResponseWriter,
+	r *http.Request,
+
+	persister adminPersister,
+
+	runner *jobs.Runner,
+	newDIDSweep sweepFactory,
+
+	did string,
+	action string,
+) error {
+	switch action {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			c, err := persister.GetConfiguration(r.Context(), did)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return problems.NotFound(errConfigurationNotFound)
+				}
+
+				return problems.Database(errCouldNotGetConfiguration, err)
+			}
+
+			return writeJSON(w, http.StatusOK, newAdminConfiguration(c))
+
+		case http.MethodDelete:
+			if _, err := persister.GetConfiguration(r.Context(), did); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return problems.NotFound(errConfigurationNotFound)
+				}
+
+				return problems.Database(errCouldNotGetConfiguration, err)
+			}
+
+			if err := persister.DeleteConfiguration(r.Context(), did); err != nil {
+				return problems.Database(errCouldNotDeleteConfiguration, err)
+			}
+
+			slog.Info("Deleted configuration using admin API", "did", did)
+
+			w.WriteHeader(http.StatusNoContent)
+
+			return nil
+
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+
+			return problems.MethodNotAllowed(r.Method)
+		}
+
+	case "enable", "disable":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+
+			return problems.MethodNotAllowed(r.Method)
+		}
+
+		c, err := persister.SetConfigurationEnabled(r.Context(), did, action == "enable")
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return problems.NotFound(errConfigurationNotFound)
+			}
+
+			return problems.Database(errCouldNotUpdateConfiguration, err)
+		}
+
+		slog.Info("Changed configuration using admin API", "did", did, "enabled", c.Enabled)
+
+		return writeJSON(w, http.StatusOK, newAdminConfiguration(c))
+
+	case "sweep":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+
+			return problems.MethodNotAllowed(r.Method)
+		}
+
+		c, err := persister.GetConfiguration(r.Context(), did)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return problems.NotFound(errConfigurationNotFound)
+			}
+
+			return problems.Database(errCouldNotGetConfiguration, err)
+		}
+
+		if !c.Enabled {
+			return problems.New(http.StatusConflict, errConfigurationDisabled, nil)
+		}
+
+		// Only one sweep runs at a time so that refresh tokens aren't rotated concurrently
+		job, created, err := runner.StartDID(ctx, did, newDIDSweep(did))
+		if err != nil {
+			return problems.New(http.StatusServiceUnavailable, errSweepBusy, err)
+		}
+
+		if created {
+			slog.Info("Started sweep using admin API", "job", job.ID(), "did", did)
+		} else {
+			slog.Info("Sweep is already running, returning existing job", "job", job.ID())
+		}
+
+		w.Header().Set("Location", "/admin/runs/"+job.ID())
+
+		return writeJSON(w, http.StatusAccepted, job.Snapshot())
+
+	default:
+		return problems.NotFound(errAdminNotFound)
+	}
+}
+
+func handleAdminRuns(w http.ResponseWriter, r *http.Request, runner *jobs.Runner, id string) error {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+
+		return problems.MethodNotAllowed(r.Method)
+	}
+
+	if id == "" {
+		return writeJSON(w, http.StatusOK, runner.List())
+	}
+
+	job, ok := runner.Get(id)
+	if !ok {
+		return problems.NotFound(errRunNotFound)
+	}
+
+	return writeJSON(w, http.StatusOK, job.Snapshot())
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request, persister adminPersister) error {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+
+		return problems.MethodNotAllowed(r.Method)
+	}
+
+	counts, err := persister.CountConfigurations(r.Context())
+	if err != nil {
+		return problems.Database(errCouldNotCountConfigurations, err)
+	}
+
+	return writeJSON(w, http.StatusOK, AdminStats{
+		Total:             counts.Total,
+		Enabled:           counts.Enabled,
+		Disabled:          counts.Total - counts.Enabled,
+		DisabledByFailure: counts.DisabledByFailure,
+	})
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/bluesky/bskytest"
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+	"github.com/pojntfx/skysweeper/pkg/models"
+	"github.com/spf13/viper"
+)
+
+const (
+	testAdminToken = "adminsecret"
+)
+
+func setupAdmin(t *testing.T, pds *bskytest.Server, persister *memoryPersister) (*httptest.Server, *jobs.Runner) {
+	t.Helper()
+
+	setupWorker(t, pds)
+	viper.Set(apiKeyFlag, "workersecret")
+	viper.Set(adminTokenFlag, testAdminToken)
+
+	runner := jobs.NewRunner(10)
+
+	mux := http.NewServeMux()
+	registerAdminHandlers(context.Background(), mux, persister, runner, newSweepFactory(persister, pds.Client()))
+
+	admin := httptest.NewServer(mux)
+	t.Cleanup(admin.Close)
+
+	return admin, runner
+}
+
+func requestAdmin(t *testing.T, admin *httptest.Server, method, path, token string, v any) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, admin.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := admin.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if v != nil && res.StatusCode < 300 {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return res
+}
+
+func TestAdminListsConfigurationsInPages(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	persister := newMemoryPersister(
+		models.Configuration{Did: "did:plc:carol", Enabled: true, PostTtl: 1},
+		models.Configuration{Did: "did:plc:alice", Enabled: true, PostTtl: 1, RefreshJwt: "secret"},
+		models.Configuration{Did: "did:plc:bob", PostTtl: 1, DisabledByFailure: true},
+	)
+	admin, _ := setupAdmin(t, pds, persister)
+
+	if res := requestAdmin(t, admin, http.MethodGet, "/admin/configurations", "workersecret", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %v with the worker API key, want %v", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	var page AdminConfigurationsPage
+	if res := requestAdmin(t, admin, http.MethodGet, "/admin/configurations?limit=2", testAdminToken, &page); res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, want %v", res.StatusCode, http.StatusOK)
+	}
+
+	if len(page.Configurations) != 2 || page.Configurations[0].DID != "did:plc:alice" || page.Next != "did:plc:bob" {
+		t.Fatalf("got page %+v, want alice and bob with a next page after bob", page)
+	}
+
+	next := page.Next
+
+	page = AdminConfigurationsPage{}
+	requestAdmin(t, admin, http.MethodGet, "/admin/configurations?limit=2&after="+next, testAdminToken, &page)
+
+	if len(page.Configurations) != 1 || page.Configurations[0].DID != "did:plc:carol" || page.Next != "" {
+		t.Fatalf("got page %+v, want only carol without a next page", page)
+	}
+
+	var stats AdminStats
+	requestAdmin(t, admin, http.MethodGet, "/admin/stats", testAdminToken, &stats)
+
+	if stats.Total != 3 || stats.Enabled != 2 || stats.Disabled != 1 || stats.DisabledByFailure != 1 {
+		t.Fatalf("got stats %+v, want 3 in total, 2 enabled and 1 disabled by failure", stats)
+	}
+}
+
+func TestAdminSweepsSingleDID(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	did, persister := setupAccount(t, pds, expired, expired, unexpired)
+	admin, runner := setupAdmin(t, pds, persister)
+
+	if res := requestAdmin(t, admin, http.MethodPost, "/admin/configurations/"+did+"/disable", testAdminToken, nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v for disable, want %v", res.StatusCode, http.StatusOK)
+	}
+
+	if res := requestAdmin(t, admin, http.MethodPost, "/admin/configurations/"+did+"/sweep", testAdminToken, nil); res.StatusCode != http.StatusConflict {
+		t.Fatalf("got status %v for sweep of disabled configuration, want %v", res.StatusCode, http.StatusConflict)
+	}
+
+	requestAdmin(t, admin, http.MethodPost, "/admin/configurations/"+did+"/enable", testAdminToken, nil)
+
+	var snapshot jobs.Snapshot
+	if res := requestAdmin(t, admin, http.MethodPost, "/admin/configurations/"+did+"/sweep", testAdminToken, &snapshot); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %v for sweep, want %v", res.StatusCode, http.StatusAccepted)
+	}
+
+	job, _ := runner.Get(snapshot.ID)
+	select {
+	case <-job.Done():
+	case <-time.After(time.Second * 10):
+		t.Fatal("sweep did not finish")
+	}
+
+	if len(pds.Posts(did)) != 1 {
+		t.Fatalf("got %v remaining posts, want %v", len(pds.Posts(did)), 1)
+	}
+
+	var runs []jobs.Snapshot
+	requestAdmin(t, admin, http.MethodGet, "/admin/runs", testAdminToken, &runs)
+
+	if len(runs) != 1 || runs[0].DID != did || runs[0].Status != jobs.StatusSucceeded || runs[0].Progress.PostsDeleted != 2 {
+		t.Fatalf("got runs %+v, want one succeeded run for %v which deleted 2 posts", runs, did)
+	}
+
+	if res := requestAdmin(t, admin, http.MethodDelete, "/admin/configurations/"+did, testAdminToken, nil); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %v for delete, want %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	if _, ok := persister.get(did); ok {
+		t.Fatal("configuration has not been deleted")
+	}
+}
@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/pojntfx/skysweeper/pkg/bluesky"
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+	"github.com/pojntfx/skysweeper/pkg/metrics"
+	"github.com/pojntfx/skysweeper/pkg/problems"
+	"github.com/spf13/viper"
+)
+
+const (
+	sweepCooldownFlag = "sweep-cooldown"
+	workerURLFlag     = "worker-url"
+	workerAPIKeyFlag  = "worker-api-key"
+)
+
+var (
+	errSweepCooldown      = errors.New("a sweep has been requested too recently, try again later")
+	errSweepBusy          = errors.New("another sweep is running, try again later")
+	errCouldNotQueueSweep = errors.New("could not queue sweep")
+	errUnexpectedStatus   = errors.New("unexpected status")
+)
+
+// ConfigurationSweep is returned when users request a sweep of their account
+type ConfigurationSweep struct {
+	JobID       string    `json:"jobId"` // Job which sweeps the account; if a sweep covering it was running already, that one's
+	Status      string    `json:"status"`
+	NextSweepAt time.Time `json:"nextSweepAt"` // Earliest time at which the next sweep can be requested
+}
+
+// sweepCooldowns limits how often each DID can request a sweep
+type sweepCooldowns struct {
+	cooldown time.Duration
+
+	requestedAt map[string]time.Time
+	lock        sync.Mutex
+}
+
+func newSweepCooldowns(cooldown time.Duration) *sweepCooldowns {
+	return &sweepCooldowns{
+		cooldown: cooldown,
+
+		requestedAt: map[string]time.Time{},
+	}
+}
+
+// reserve records that did requested a sweep at now and returns when it can request the next one; if it
+// already requested one within the cooldown, nothing is recorded and false is returned
+func (c *sweepCooldowns) reserve(did string, now time.Time) (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Forget expired reservations so that the map only grows with recent requests
+	for d, at := range c.requestedAt {
+		if now.Sub(at) >= c.cooldown {
+			delete(c.requestedAt, d)
+		}
+	}
+
+	if at, ok := c.requestedAt[did]; ok {
+		return at.Add(c.cooldown), false
+	}
+
+	c.requestedAt[did] = now
+
+	return now.Add(c.cooldown), true
+}
+
+// release forgets the reservation of did, e.g. because its sweep could not be queued
+func (c *sweepCooldowns) release(did string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.requestedAt, did)
+}
+
+// sweepTrigger queues a sweep for only the configuration of did; if a sweep covering it is running already, the
+// running one is returned instead, and if a sweep of another DID is running, jobs.ErrBusy is returned
+type sweepTrigger func(ctx context.Context, did string) (jobs.Snapshot, error)
+
+// newRunnerSweepTrigger returns a trigger which starts sweeps in this process; cancelling ctx stops them
+func newRunnerSweepTrigger(ctx context.Context, runner *jobs.Runner, newDIDSweep sweepFactory) sweepTrigger {
+	return func(_ context.Context, did string) (jobs.Snapshot, error) {
+		job, created, err := runner.StartDID(ctx, did, newDIDSweep(did))
+		if err != nil {
+			return jobs.Snapshot{}, err
+		}
+
+		if created {
+			slog.Info("Started sweep requested by user", "job", job.ID(), "did", did)
+		}
+
+		return job.Snapshot(), nil
+	}
+}
+
+// newWorkerSweepTrigger returns a trigger which starts sweeps using the `/posts` endpoint of a worker
+func newWorkerSweepTrigger(httpClient *http.Client, workerURL string, apiKey string) sweepTrigger {
+	return func(ctx context.Context, did string) (jobs.Snapshot, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, workerURL+"/posts?did="+url.QueryEscape(did), nil)
+		if err != nil {
+			return jobs.Snapshot{}, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return jobs.Snapshot{}, err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusServiceUnavailable {
+			return jobs.Snapshot{}, jobs.ErrBusy
+		}
+
+		if res.StatusCode != http.StatusAccepted {
+			return jobs.Snapshot{}, fmt.Errorf("%w: %v", errUnexpectedStatus, res.Status)
+		}
+
+		var snapshot jobs.Snapshot
+		if err := json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+			return jobs.Snapshot{}, err
+		}
+
+		return snapshot, nil
+	}
+}
+
+// newConfigurationSweepHandler returns the handler for `/configuration/sweep`, which lets users queue a
+// sweep of only their own account with their Bluesky session
+func newConfigurationSweepHandler(
+	persister configurationPersister,
+
+	servicePolicy *bluesky.ServicePolicy,
+	serviceClient *http.Client,
+
+	cooldowns *sweepCooldowns,
+	trigger sweepTrigger,
+) http.Handler {
+	return metrics.InstrumentHandler("configuration_sweep", problems.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		allowOrigin(w, r, "POST")
+
+		if r.Method == http.MethodOptions {
+			return nil
+		}
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+
+			return problems.MethodNotAllowed(r.Method)
+		}
+
+		client, _, err := authenticate(r, servicePolicy, serviceClient)
+		if err != nil {
+			return err
+		}
+
+		session, err := atproto.ServerGetSession(r.Context(), client)
+		if err != nil {
+			return problems.Session(errCouldNotGetSession, err)
+		}
+
+		config, err := persister.GetConfiguration(r.Context(), session.Did)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return problems.NotFound(errConfigurationNotFound)
+			}
+
+			return problems.Database(errCouldNotGetConfiguration, err)
+		}
+
+		if !config.Enabled {
+			return problems.New(http.StatusConflict, errConfigurationDisabled, nil)
+		}
+
+		now := time.Now()
+
+		nextSweepAt, ok := cooldowns.reserve(session.Did, now)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(nextSweepAt.Sub(now).Seconds()))))
+
+			return problems.New(http.StatusTooManyRequests, errSweepCooldown, nil)
+		}
+
+		snapshot, err := trigger(r.Context(), session.Did)
+		if err != nil {
+			cooldowns.release(session.Did)
+
+			// A running sweep of all configurations includes the caller's, but one of another DID doesn't
+			if errors.Is(err, jobs.ErrBusy) {
+				return problems.New(http.StatusServiceUnavailable, errSweepBusy, nil)
+			}
+
+			return problems.New(http.StatusBadGateway, errCouldNotQueueSweep, err)
+		}
+
+		return writeJSON(w, http.StatusAccepted, ConfigurationSweep{
+			JobID:       snapshot.ID,
+			Status:      snapshot.Status,
+			NextSweepAt: nextSweepAt,
+		})
+	}))
+}
+
+// registerConfigurationSweepHandler adds `/configuration/sweep` to mux using the configured cooldown
+func registerConfigurationSweepHandler(
+	mux *http.ServeMux,
+
+	persister configurationPersister,
+
+	servicePolicy *bluesky.ServicePolicy,
+	serviceClient *http.Client,
+
+	trigger sweepTrigger,
+) {
+	mux.Handle("/configuration/sweep", newConfigurationSweepHandler(
+		persister,
+
+		servicePolicy,
+		serviceClient,
+
+		newSweepCooldowns(viper.GetDuration(sweepCooldownFlag)),
+		trigger,
+	))
+}
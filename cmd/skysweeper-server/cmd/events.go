@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+)
+
+const (
+	eventsKeepaliveInterval = time.Second * 15
+
+	eventProgress = "progress"
+)
+
+var (
+	errStreamingUnsupported = errors.New("streaming is not supported")
+)
+
+// streamJobEvents sends the events of job to w as server-sent events until the job has finished,
+// the client has disconnected or ctx is cancelled. If did is not empty, only events for this DID
+// and events which aren't specific to a DID (e.g. throttling) are sent. Once the stream has started, write errors mean that
+// the client has gone away, so they end the stream without an error.
+func streamJobEvents(
+	ctx context.Context,
+
+	w http.ResponseWriter,
+	r *http.Request,
+
+	job *jobs.Job,
+	did string,
+) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errStreamingUnsupported
+	}
+
+	// Subscribe before sending the current progress so that no events are missed in between
+	events, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	snapshot := job.Snapshot()
+	if err := writeEvent(w, eventProgress, snapshot); err != nil {
+		return nil
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventsKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			if did != "" && event.DID != "" && event.DID != did {
+				continue
+			}
+
+			if err := writeEvent(w, event.Type, event); err != nil {
+				return nil
+			}
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+
+		case <-r.Context().Done():
+			return nil
+
+		case <-ctx.Done():
+			return nil
+		}
+
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, name string, data any) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCouldNotEncode, err)
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, d)
+
+	return err
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/persisters"
+	"github.com/pojntfx/skysweeper/pkg/problems"
+)
+
+const (
+	readinessTimeout = time.Second * 5
+)
+
+var (
+	errNotReady = errors.New("not ready")
+)
+
+type Health struct {
+	Status string `json:"status"`
+}
+
+type Readiness struct {
+	Status        string `json:"status"`
+	SchemaVersion int64  `json:"schemaVersion"`
+	Sweeping      *bool  `json:"sweeping,omitempty"`
+}
+
+// registerHealthHandlers adds a liveness (`/healthz`) and a readiness (`/readyz`) endpoint to mux;
+// if sweeping is not nil, the readiness endpoint also reports whether a sweep is in progress
+func registerHealthHandlers(
+	mux *http.ServeMux,
+
+	ready func(ctx context.Context) (int64, error),
+	sweeping func() bool,
+) {
+	mux.Handle("/healthz", problems.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(Health{
+			Status: "ok",
+		}); err != nil {
+			return fmt.Errorf("%w: %v", errCouldNotEncode, err)
+		}
+
+		return nil
+	}))
+
+	mux.Handle("/readyz", problems.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		version, err := ready(ctx)
+		if err != nil {
+			if errors.Is(err, persisters.ErrSchemaOutdated) {
+				return problems.New(http.StatusServiceUnavailable, err, nil)
+			}
+
+			return problems.New(http.StatusServiceUnavailable, errNotReady, err)
+		}
+
+		res := Readiness{
+			Status:        "ready",
+			SchemaVersion: version,
+		}
+
+		if sweeping != nil {
+			s := sweeping()
+			res.Sweeping = &s
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			return fmt.Errorf("%w: %v", errCouldNotEncode, err)
+		}
+
+		return nil
+	}))
+}
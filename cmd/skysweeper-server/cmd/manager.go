@@ -1,35 +1,63 @@
 package cmd
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/bluesky"
+	"github.com/pojntfx/skysweeper/pkg/metrics"
+	"github.com/pojntfx/skysweeper/pkg/models"
 	"github.com/pojntfx/skysweeper/pkg/persisters"
+	"github.com/pojntfx/skysweeper/pkg/problems"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 const (
 	originFlag = "origin"
+
+	serviceAllowlistFlag       = "service-allowlist"
+	serviceDenylistFlag        = "service-denylist"
+	allowPrivateServicesFlag   = "allow-private-services"
+	requireDIDServiceMatchFlag = "require-did-service-match"
+
+	maxPostTTLFlag  = "max-post-ttl"
+	maxBodySizeFlag = "max-body-size"
+
+	contentTypeJSON       = "application/json"
+	contentTypeMergePatch = "application/merge-patch+json"
 )
 
 var (
 	errCouldNotGetConfiguration    = errors.New("could not get configuraion")
+	errConfigurationNotFound       = errors.New("configuration not found")
 	errCouldNotUpsertConfiguration = errors.New("could not upsert configuration")
 	errCouldNotDeleteConfiguration = errors.New("could not delete configuration")
+	errCouldNotPatchConfiguration  = errors.New("could not patch configuration")
+
+	errUnsupportedContentType = errors.New("unsupported content type")
 
 	errCouldNotEncode = errors.New("could not encode")
-	errCouldNotDecode = errors.New("could not decode")
 
-	errMissingService = errors.New("missing service")
+	errMissingAuthorization = errors.New("missing authorization")
+	errMissingService       = errors.New("missing service")
+	errServiceDoesNotMatch  = errors.New("service does not match PDS in DID document")
+	errCouldNotResolvePDS   = errors.New("could not resolve PDS")
+	errCouldNotValidateDID  = errors.New("could not validate DID")
 
 	errCouldNotGetSession     = errors.New("could not get session")
 	errCouldNotRefreshSession = errors.New("could not refresh session")
@@ -38,170 +66,435 @@ var (
 type Configuration struct {
 	Enabled bool  `json:"enabled"`
 	PostTTL int32 `json:"postTTL"`
+
+	Backlog *ConfigurationBacklog `json:"backlog,omitempty"` // Only returned by GET
 }
 
-var managerCmd = &cobra.Command{
-	Use:     "manager",
-	Aliases: []string{"w"},
-	Short:   "Start an SkySweeper manager",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		if err := viper.BindPFlags(cmd.PersistentFlags()); err != nil {
-			return err
+// ConfigurationBacklog estimates the expired posts which are left after the last sweep, since every sweep only
+// spends a limited amount of rate limit points per account
+type ConfigurationBacklog struct {
+	PostsPending int64 `json:"postsPending"`     // Approximate number of expired posts left
+	Sweeps       int64 `json:"sweeps,omitempty"` // Estimated number of sweeps until they are deleted; omitted if unknown
+}
+
+// newConfigurationBacklog returns the backlog of c or nil if the last sweep has deleted all of its expired posts
+func newConfigurationBacklog(c models.Configuration) *ConfigurationBacklog {
+	if !c.BacklogPending {
+		return nil
+	}
+
+	backlog := &ConfigurationBacklog{
+		PostsPending: c.PostsPending,
+	}
+
+	// Assumes that the next sweeps get the same share of rate limit points as the last one
+	if c.LastSweptPosts > 0 {
+		backlog.Sweeps = max((c.PostsPending+c.LastSweptPosts-1)/c.LastSweptPosts, 1)
+	}
+
+	return backlog
+}
+
+// ConfigurationPatch is a JSON merge patch for a configuration (see RFC 7396)
+type ConfigurationPatch struct {
+	Enabled json.RawMessage `json:"enabled"`
+	PostTTL json.RawMessage `json:"postTTL"`
+}
+
+func (p ConfigurationPatch) Parse(maxPostTTL int32) (*bool, *int32, []problems.FieldError) {
+	fieldErrors := []problems.FieldError{}
+
+	var enabled *bool
+	if p.Enabled != nil {
+		if err := json.Unmarshal(p.Enabled, &enabled); err != nil {
+			fieldErrors = append(fieldErrors, problems.FieldError{
+				Pointer: "#/enabled",
+				Detail:  "must be a boolean",
+			})
+		} else if enabled == nil {
+			fieldErrors = append(fieldErrors, problems.FieldError{
+				Pointer: "#/enabled",
+				Detail:  "can not be removed",
+			})
+		}
+	}
+
+	var postTTL *int32
+	if p.PostTTL != nil {
+		if err := json.Unmarshal(p.PostTTL, &postTTL); err != nil {
+			fieldErrors = append(fieldErrors, problems.FieldError{
+				Pointer: "#/postTTL",
+				Detail:  "must be an integer",
+			})
+		} else if postTTL == nil {
+			fieldErrors = append(fieldErrors, problems.FieldError{
+				Pointer: "#/postTTL",
+				Detail:  "can not be removed",
+			})
+		} else {
+			fieldErrors = append(fieldErrors, Configuration{PostTTL: *postTTL}.Validate(maxPostTTL)...)
 		}
+	}
 
-		persister := persisters.NewManagerPersister(viper.GetString(postgresURLFlag))
+	return enabled, postTTL, fieldErrors
+}
 
-		if err := persister.Open(); err != nil {
-			return err
+func (c Configuration) Validate(maxPostTTL int32) []problems.FieldError {
+	fieldErrors := []problems.FieldError{}
+
+	if c.PostTTL < 1 {
+		fieldErrors = append(fieldErrors, problems.FieldError{
+			Pointer: "#/postTTL",
+			Detail:  "must be at least 1 month",
+		})
+	} else if c.PostTTL > maxPostTTL {
+		fieldErrors = append(fieldErrors, problems.FieldError{
+			Pointer: "#/postTTL",
+			Detail:  fmt.Sprintf("must be at most %v months", maxPostTTL),
+		})
+	}
+
+	return fieldErrors
+}
+
+// configurationPersister is the subset of `persisters.ManagerPersister` needed to manage configurations
+type configurationPersister interface {
+	GetConfiguration(ctx context.Context, did string) (models.Configuration, error)
+	UpsertConfiguration(ctx context.Context, did string, service string, refreshJWT string, enabled bool, postTtl int32) (models.Configuration, error)
+	PatchConfiguration(ctx context.Context, did string, service string, refreshJWT string, enabled *bool, postTtl *int32) (models.Configuration, error)
+	DeleteConfiguration(ctx context.Context, did string) error
+}
+
+// allowOrigin sets the CORS headers for methods if the request comes from the configured origin
+func allowOrigin(w http.ResponseWriter, r *http.Request, methods string) {
+	if o := r.Header.Get("Origin"); o == viper.GetString(originFlag) {
+		w.Header().Set("Access-Control-Allow-Origin", o)
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// authenticate returns a client for the service in the request which uses the caller's access token
+func authenticate(
+	r *http.Request,
+
+	servicePolicy *bluesky.ServicePolicy,
+	serviceClient *http.Client,
+) (*xrpc.Client, string, error) {
+	accessJwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.TrimSpace(accessJwt) == "" {
+		return nil, "", problems.Unauthorized(errMissingAuthorization)
+	}
+
+	service := r.URL.Query().Get("service")
+	if strings.TrimSpace(service) == "" {
+		return nil, "", problems.UnprocessableEntity(errMissingService)
+	}
+
+	if err := servicePolicy.Validate(r.Context(), service); err != nil {
+		return nil, "", problems.UnprocessableEntity(err)
+	}
+
+	if viper.GetBool(requireDIDServiceMatchFlag) {
+		did, err := bluesky.GetDIDFromJWT(accessJwt)
+		if err != nil {
+			return nil, "", problems.New(http.StatusUnauthorized, errCouldNotValidateDID, err)
 		}
-		defer persister.Close()
 
-		log.Println("Connected to PostgreSQL")
+		pds, err := bluesky.ResolvePDS(r.Context(), serviceClient, viper.GetString(plcDirectoryURLFlag), did)
+		if err != nil {
+			return nil, "", problems.New(http.StatusUnprocessableEntity, errCouldNotResolvePDS, err)
+		}
 
-		lis, err := net.Listen("tcp", viper.GetString(laddrFlag))
+		if !bluesky.ServicesEqual(pds, service) {
+			return nil, "", problems.UnprocessableEntity(errServiceDoesNotMatch)
+		}
+	}
+
+	client := &xrpc.Client{
+		Client: serviceClient,
+		Host:   service,
+		Auth: &xrpc.AuthInfo{
+			AccessJwt: accessJwt,
+		},
+	}
+
+	return client, service, nil
+}
+
+// newConfigurationHandler returns the handler for `/configuration`, which lets users manage their
+// configuration with their Bluesky session
+func newConfigurationHandler(
+	persister configurationPersister,
+
+	servicePolicy *bluesky.ServicePolicy,
+	serviceClient *http.Client,
+) http.Handler {
+	return metrics.InstrumentHandler("configuration", problems.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		allowOrigin(w, r, "GET, PUT, PATCH, DELETE")
+
+		if r.Method == http.MethodOptions {
+			return nil
+		}
+
+		client, service, err := authenticate(r, servicePolicy, serviceClient)
 		if err != nil {
 			return err
 		}
-		defer lis.Close()
 
-		log.Println("Listening on", lis.Addr())
+		switch r.Method {
+		case http.MethodGet:
+			session, err := atproto.ServerGetSession(r.Context(), client)
+			if err != nil {
+				return problems.Session(errCouldNotGetSession, err)
+			}
 
-		mux := http.NewServeMux()
+			config, err := persister.GetConfiguration(r.Context(), session.Did)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return problems.NotFound(errConfigurationNotFound)
+				}
 
-		mux.HandleFunc("/configuration", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if o := r.Header.Get("Origin"); o == viper.GetString(originFlag) {
-				w.Header().Set("Access-Control-Allow-Origin", o)
-				w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE")
-				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				return problems.Database(errCouldNotGetConfiguration, err)
 			}
 
-			if r.Method == http.MethodOptions {
-				return
+			res := Configuration{
+				Enabled: config.Enabled,
+				PostTTL: config.PostTtl,
+				Backlog: newConfigurationBacklog(config),
 			}
 
-			accessJwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-			if strings.TrimSpace(accessJwt) == "" {
-				w.WriteHeader(http.StatusUnauthorized)
+			w.Header().Set("Content-Type", "application/json")
 
-				return
+			if err := json.NewEncoder(w).Encode(res); err != nil {
+				return fmt.Errorf("%w: %v", errCouldNotEncode, err)
 			}
 
-			service := r.URL.Query().Get("service")
-			if strings.TrimSpace(service) == "" {
-				http.Error(w, errMissingService.Error(), http.StatusUnprocessableEntity)
-
-				log.Println(errMissingService)
+		case http.MethodPut:
+			// Validate before refreshing the session, since refreshing invalidates the client's refresh token
+			var req Configuration
+			if err := problems.DecodeJSON(w, r, &req, viper.GetInt64(maxBodySizeFlag)); err != nil {
+				return err
+			}
 
-				return
+			if fieldErrors := req.Validate(int32(viper.GetInt(maxPostTTLFlag))); len(fieldErrors) > 0 {
+				return problems.Invalid(problems.ErrInvalidFields, fieldErrors)
 			}
 
-			defer func() {
-				if err := recover(); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+			session, err := atproto.ServerRefreshSession(r.Context(), client)
+			if err != nil {
+				return problems.Session(errCouldNotRefreshSession, err)
+			}
 
-					log.Printf("Client disconnected with error: %v", err)
-				}
-			}()
+			config, err := persister.UpsertConfiguration(
+				r.Context(),
+				session.Did,
+				service,
+				session.RefreshJwt,
+				req.Enabled,
+				req.PostTTL,
+			)
+			if err != nil {
+				return problems.Database(errCouldNotUpsertConfiguration, err)
+			}
 
-			client := &xrpc.Client{
-				Client: http.DefaultClient,
-				Host:   service,
-				Auth: &xrpc.AuthInfo{
-					AccessJwt: accessJwt,
-				},
+			res := Configuration{
+				Enabled: config.Enabled,
+				PostTTL: config.PostTtl,
 			}
 
-			switch r.Method {
-			case http.MethodGet:
-				session, err := atproto.ServerGetSession(r.Context(), client)
-				if err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotGetSession, err))
-				}
+			w.Header().Set("Content-Type", "application/json")
 
-				config, err := persister.GetConfiguration(r.Context(), session.Did)
-				if err != nil {
-					if errors.Is(err, sql.ErrNoRows) {
-						w.WriteHeader(http.StatusNotFound)
+			if err := json.NewEncoder(w).Encode(res); err != nil {
+				return fmt.Errorf("%w: %v", errCouldNotEncode, err)
+			}
 
-						return
-					}
+		case http.MethodPatch:
+			if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, contentTypeMergePatch) && !strings.HasPrefix(ct, contentTypeJSON) {
+				return problems.New(http.StatusUnsupportedMediaType, fmt.Errorf("%w: %v", errUnsupportedContentType, ct), nil)
+			}
 
-					panic(fmt.Errorf("%w: %v", errCouldNotGetConfiguration, err))
-				}
+			var req ConfigurationPatch
+			if err := problems.DecodeJSON(w, r, &req, viper.GetInt64(maxBodySizeFlag)); err != nil {
+				return err
+			}
 
-				res := Configuration{
-					Enabled: config.Enabled,
-					PostTTL: config.PostTtl,
-				}
+			enabled, postTTL, fieldErrors := req.Parse(int32(viper.GetInt(maxPostTTLFlag)))
+			if len(fieldErrors) > 0 {
+				return problems.Invalid(problems.ErrInvalidFields, fieldErrors)
+			}
 
-				w.Header().Set("Content-Type", "application/json")
+			// Refreshing rotates the caller's refresh token, so check that there is a configuration to store the new one in first;
+			// the DID in the JWT can't be trusted before the PDS has accepted it, so the patch below still uses the refreshed session's
+			did, err := bluesky.GetDIDFromJWT(client.Auth.AccessJwt)
+			if err != nil {
+				return problems.New(http.StatusUnauthorized, errCouldNotValidateDID, err)
+			}
 
-				if err := json.NewEncoder(w).Encode(res); err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotEncode, err))
+			if _, err := persister.GetConfiguration(r.Context(), did); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return problems.NotFound(errConfigurationNotFound)
 				}
 
-			case http.MethodPut:
-				session, err := atproto.ServerRefreshSession(r.Context(), client)
-				if err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotRefreshSession, err))
-				}
+				return problems.Database(errCouldNotGetConfiguration, err)
+			}
 
-				var req Configuration
-				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotDecode, err))
-				}
+			session, err := atproto.ServerRefreshSession(r.Context(), client)
+			if err != nil {
+				return problems.Session(errCouldNotRefreshSession, err)
+			}
 
-				config, err := persister.UpsertConfiguration(
-					r.Context(),
-					session.Did,
-					service,
-					session.RefreshJwt,
-					req.Enabled,
-					req.PostTTL,
-				)
-				if err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotUpsertConfiguration, err))
+			config, err := persister.PatchConfiguration(
+				r.Context(),
+				session.Did,
+				service,
+				session.RefreshJwt,
+				enabled,
+				postTTL,
+			)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return problems.NotFound(errConfigurationNotFound)
 				}
 
-				res := Configuration{
-					Enabled: config.Enabled,
-					PostTTL: config.PostTtl,
-				}
+				return problems.Database(errCouldNotPatchConfiguration, err)
+			}
 
-				w.Header().Set("Content-Type", "application/json")
+			res := Configuration{
+				Enabled: config.Enabled,
+				PostTTL: config.PostTtl,
+			}
 
-				if err := json.NewEncoder(w).Encode(res); err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotEncode, err))
-				}
+			w.Header().Set("Content-Type", "application/json")
 
-			case http.MethodDelete:
-				session, err := atproto.ServerGetSession(r.Context(), client)
-				if err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotGetSession, err))
-				}
+			if err := json.NewEncoder(w).Encode(res); err != nil {
+				return fmt.Errorf("%w: %v", errCouldNotEncode, err)
+			}
 
-				if err := persister.DeleteConfiguration(r.Context(), session.Did); err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotDeleteConfiguration, err))
-				}
+		case http.MethodDelete:
+			session, err := atproto.ServerGetSession(r.Context(), client)
+			if err != nil {
+				return problems.Session(errCouldNotGetSession, err)
+			}
 
-			default:
-				w.WriteHeader(http.StatusMethodNotAllowed)
+			if err := persister.DeleteConfiguration(r.Context(), session.Did); err != nil {
+				return problems.Database(errCouldNotDeleteConfiguration, err)
 			}
-		}))
 
-		if err := http.Serve(lis, mux); err != nil {
-			return err
+		default:
+			w.Header().Set("Allow", "GET, PUT, PATCH, DELETE, OPTIONS")
+
+			return problems.MethodNotAllowed(r.Method)
 		}
 
 		return nil
+	}))
+}
+
+var managerCmd = &cobra.Command{
+	Use:     "manager",
+	Aliases: []string{"w"},
+	Short:   "Start an SkySweeper manager",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := viper.BindPFlags(cmd.PersistentFlags()); err != nil {
+			return err
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		persister := persisters.NewManagerPersister(viper.GetString(databaseURLFlag))
+
+		if err := persister.Open(); err != nil {
+			return err
+		}
+		defer persister.Close()
+
+		slog.Info("Connected to database", "backend", persister.Backend())
+
+		if err := prepareSchema(ctx, persister.Migrate, persister.Ready, viper.GetBool(autoMigrateFlag)); err != nil {
+			return err
+		}
+
+		lis, err := net.Listen("tcp", viper.GetString(laddrFlag))
+		if err != nil {
+			return err
+		}
+		defer lis.Close()
+
+		slog.Info("Listening", "laddr", lis.Addr().String())
+
+		servicePolicy := newServicePolicy()
+		serviceClient := servicePolicy.NewHTTPClient()
+		serviceClient.Transport = metrics.NewTransport(serviceClient.Transport, viper.GetStringSlice(serviceAllowlistFlag))
+
+		if err := metrics.RegisterConfigurationsCollector(persister.CountConfigurations); err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+
+		mux.Handle("/metrics", metrics.Handler())
+
+		registerHealthHandlers(mux, persister.Ready, nil)
+
+		mux.Handle("/configuration", newConfigurationHandler(persister, servicePolicy, serviceClient))
+
+		if workerURL := strings.TrimSuffix(viper.GetString(workerURLFlag), "/"); workerURL == "" {
+			slog.Info("No worker URL set, not serving the sweep endpoint")
+		} else {
+			workerClient := &http.Client{
+				Transport: metrics.NewTransport(http.DefaultTransport, nil),
+			}
+
+			registerConfigurationSweepHandler(mux, persister, servicePolicy, serviceClient, newWorkerSweepTrigger(workerClient, workerURL, viper.GetString(workerAPIKeyFlag)))
+		}
+
+		return serve(ctx, lis, mux, viper.GetDuration(shutdownTimeoutFlag))
 	},
 }
 
+// addServicePolicyFlags adds the flags which restrict the services that refresh tokens are sent to to flags
+func addServicePolicyFlags(flags *pflag.FlagSet) {
+	flags.StringSlice(serviceAllowlistFlag, []string{}, "Hosts to allow as services (supports *. prefixes for subdomains; if empty, all hosts that aren't denylisted are allowed)")
+	flags.StringSlice(serviceDenylistFlag, []string{}, "Hosts to deny as services (supports *. prefixes for subdomains)")
+	flags.Bool(allowPrivateServicesFlag, false, "Whether to allow services which resolve to private, loopback or link-local addresses or use plain HTTP (only enable this for local development)")
+}
+
+// newServicePolicy returns the policy of the service policy flags
+func newServicePolicy() *bluesky.ServicePolicy {
+	return bluesky.NewServicePolicy(
+		viper.GetStringSlice(serviceAllowlistFlag),
+		viper.GetStringSlice(serviceDenylistFlag),
+		viper.GetBool(allowPrivateServicesFlag),
+	)
+}
+
+// addConfigurationFlags adds the flags which configure the configuration API to flags
+func addConfigurationFlags(flags *pflag.FlagSet) {
+	flags.String(originFlag, "https://skysweeper.p8.lu", "Allowed CORS origin")
+
+	flags.Int(maxPostTTLFlag, 120, "Maximum post TTL in months that can be configured")
+	flags.Int64(maxBodySizeFlag, 4096, "Maximum size of request bodies in bytes")
+
+	addServicePolicyFlags(flags)
+	flags.Bool(requireDIDServiceMatchFlag, false, "Whether to require the service to match the PDS in the caller's DID document")
+
+	flags.Duration(sweepCooldownFlag, time.Hour, "Time users have to wait between requesting sweeps of their account (if zero, sweeps can be requested at any time)")
+}
+
 func init() {
 	managerCmd.PersistentFlags().String(laddrFlag, ":1337", "Listen address")
+	managerCmd.PersistentFlags().Duration(shutdownTimeoutFlag, time.Second*30, "Time to wait for in-flight requests to finish when shutting down")
+	managerCmd.PersistentFlags().Bool(autoMigrateFlag, false, "Whether to apply pending migrations on startup (if false, the server only verifies the schema version and refuses to start if it is outdated; see the migrate command)")
+
+	addConfigurationFlags(managerCmd.PersistentFlags())
+
+	managerCmd.PersistentFlags().String(workerURLFlag, "", "URL of the worker to queue sweeps requested by users with (e.g. http://localhost:1338; if empty, users can't request sweeps)")
+	managerCmd.PersistentFlags().String(workerAPIKeyFlag, "", "API key to authenticate to the worker with")
 
-	managerCmd.PersistentFlags().String(originFlag, "https://skysweeper.p8.lu", "Allowed CORS origin")
+	managerCmd.PersistentFlags().String(plcDirectoryURLFlag, "https://plc.directory", "PLC directory URL to resolve did:plc DID documents with (used to validate services)")
 
 	viper.AutomaticEnv()
 
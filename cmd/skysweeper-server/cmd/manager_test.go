@@ -0,0 +1,364 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/bluesky"
+	"github.com/pojntfx/skysweeper/pkg/bluesky/bskytest"
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+	"github.com/pojntfx/skysweeper/pkg/problems"
+	"github.com/spf13/viper"
+)
+
+func setupManager(t *testing.T, pds *bskytest.Server, persister configurationPersister) *httptest.Server {
+	t.Helper()
+
+	viper.Set(originFlag, "http://localhost:3000")
+	viper.Set(maxPostTTLFlag, 120)
+	viper.Set(maxBodySizeFlag, 4096)
+	viper.Set(requireDIDServiceMatchFlag, true)
+	viper.Set(plcDirectoryURLFlag, pds.PLCDirectoryURL())
+
+	t.Cleanup(viper.Reset)
+
+	// The PDS listens on loopback
+	servicePolicy := bluesky.NewServicePolicy(nil, nil, true)
+
+	manager := httptest.NewServer(newConfigurationHandler(persister, servicePolicy, servicePolicy.NewHTTPClient()))
+	t.Cleanup(manager.Close)
+
+	return manager
+}
+
+func login(t *testing.T, pds *bskytest.Server) *atproto.ServerCreateSession_Output {
+	t.Helper()
+
+	session, err := atproto.ServerCreateSession(context.Background(), &xrpc.Client{
+		Client: pds.Client(),
+		Host:   pds.URL,
+	}, &atproto.ServerCreateSession_Input{
+		Identifier: testHandle,
+		Password:   testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session
+}
+
+func requestConfiguration(t *testing.T, manager *httptest.Server, pds *bskytest.Server, method, jwt, contentType, body string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, manager.URL+"?service="+url.QueryEscape(pds.URL), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := manager.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil && method != http.MethodDelete {
+		t.Fatal(err)
+	}
+
+	return res, raw
+}
+
+func TestManagerConfigurationLifecycle(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	did := pds.AddAccount(testHandle, testPassword)
+
+	persister := newMemoryPersister()
+	manager := setupManager(t, pds, persister)
+
+	session := login(t, pds)
+
+	// Configurations are created with the refresh token, which the manager exchanges for one it keeps
+	res, _ := requestConfiguration(t, manager, pds, http.MethodPut, session.RefreshJwt, contentTypeJSON, `{"enabled":true,"postTTL":6}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v for PUT, want %v", res.StatusCode, http.StatusOK)
+	}
+
+	c, ok := persister.get(did)
+	if !ok || !c.Enabled || c.PostTtl != 6 || c.Service != pds.URL {
+		t.Fatalf("got configuration %+v, want an enabled configuration for the PDS with a post TTL of 6", c)
+	}
+
+	if c.RefreshJwt == session.RefreshJwt {
+		t.Fatal("refresh token has not been exchanged")
+	}
+	assertRefreshable(t, pds, c.RefreshJwt)
+
+	res, body := requestConfiguration(t, manager, pds, http.MethodGet, session.AccessJwt, "", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v for GET, want %v", res.StatusCode, http.StatusOK)
+	}
+
+	var got Configuration
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.Enabled || got.PostTTL != 6 || got.Backlog != nil {
+		t.Fatalf("got configuration %+v, want an enabled configuration with a post TTL of 6 and no backlog", got)
+	}
+
+	// A sweep which has deleted 100 posts before spending its budget leaves an estimated 250 posts for 3 more sweeps
+	if err := persister.UpdateSweepStatistics(context.Background(), did, 200, true, 250, 100, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, body = requestConfiguration(t, manager, pds, http.MethodGet, session.AccessJwt, "", "")
+
+	got = Configuration{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Backlog == nil || got.Backlog.PostsPending != 250 || got.Backlog.Sweeps != 3 {
+		t.Fatalf("got backlog %+v, want 250 pending posts and 3 sweeps", got.Backlog)
+	}
+
+	session = login(t, pds)
+
+	res, _ = requestConfiguration(t, manager, pds, http.MethodPatch, session.RefreshJwt, contentTypeMergePatch, `{"enabled":false}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v for PATCH, want %v", res.StatusCode, http.StatusOK)
+	}
+
+	if c, _ := persister.get(did); c.Enabled || c.PostTtl != 6 {
+		t.Fatalf("got configuration %+v, want a disabled configuration with an unchanged post TTL", c)
+	}
+
+	res, _ = requestConfiguration(t, manager, pds, http.MethodDelete, session.AccessJwt, "", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v for DELETE, want %v", res.StatusCode, http.StatusOK)
+	}
+
+	if _, ok := persister.get(did); ok {
+		t.Fatal("configuration has not been deleted")
+	}
+
+	res, _ = requestConfiguration(t, manager, pds, http.MethodGet, session.AccessJwt, "", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %v for GET after DELETE, want %v", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestManagerDoesNotRefreshSessionForInvalidConfiguration(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	pds.AddAccount(testHandle, testPassword)
+
+	manager := setupManager(t, pds, newMemoryPersister())
+
+	session := login(t, pds)
+
+	res, body := requestConfiguration(t, manager, pds, http.MethodPut, session.RefreshJwt, contentTypeJSON, `{"enabled":true,"postTTL":0}`)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %v, want %v", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	var problem problems.Problem
+	if err := json.Unmarshal(body, &problem); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problem.Errors) != 1 || problem.Errors[0].Pointer != "#/postTTL" {
+		t.Fatalf("got field errors %+v, want one for #/postTTL", problem.Errors)
+	}
+
+	if calls := pds.Calls(bskytest.MethodRefreshSession); calls != 0 {
+		t.Fatalf("got %v refreshSession calls, want none", calls)
+	}
+
+	// The client's refresh token must still be valid
+	assertRefreshable(t, pds, session.RefreshJwt)
+}
+
+func TestManagerDoesNotRefreshSessionForMissingConfiguration(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	pds.AddAccount(testHandle, testPassword)
+
+	manager := setupManager(t, pds, newMemoryPersister())
+
+	session := login(t, pds)
+
+	res, _ := requestConfiguration(t, manager, pds, http.MethodPatch, session.RefreshJwt, contentTypeMergePatch, `{"enabled":true}`)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %v, want %v", res.StatusCode, http.StatusNotFound)
+	}
+
+	if calls := pds.Calls(bskytest.MethodRefreshSession); calls != 0 {
+		t.Fatalf("got %v refreshSession calls, want none", calls)
+	}
+
+	// The client's refresh token must still be valid
+	assertRefreshable(t, pds, session.RefreshJwt)
+}
+
+func TestManagerRejectsExpiredSession(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	did := pds.AddAccount(testHandle, testPassword)
+
+	manager := setupManager(t, pds, newMemoryPersister())
+
+	session := login(t, pds)
+	pds.RevokeSessions(did)
+
+	res, _ := requestConfiguration(t, manager, pds, http.MethodGet, session.AccessJwt, "", "")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %v, want %v", res.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestManagerRejectsServiceWhichIsNotTheCallersPDS(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	pds.AddAccount(testHandle, testPassword)
+
+	other := bskytest.NewServer()
+	defer other.Close()
+
+	// The DID document is resolved using the first PDS, so the other PDS doesn't match it
+	manager := setupManager(t, pds, newMemoryPersister())
+
+	session := login(t, pds)
+
+	res, _ := requestConfiguration(t, manager, other, http.MethodGet, session.AccessJwt, "", "")
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %v, want %v", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestManagerQueuesSweepOfCallersAccountWithCooldown(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	setupWorker(t, pds)
+	viper.Set(apiKeyFlag, "workersecret")
+	viper.Set(requireDIDServiceMatchFlag, true)
+
+	did, persister := setupAccount(t, pds, expired, expired, unexpired)
+
+	otherDID := pds.AddAccount("bob.test", "bobpassword")
+	pds.AddPost(otherDID, time.Now().Add(-expired))
+
+	_, otherRefreshJwt := pds.CreateSession(otherDID)
+	if _, err := persister.UpsertConfiguration(context.Background(), otherDID, pds.URL, otherRefreshJwt, true, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users' sweeps are queued using the worker's endpoint, just like in a split deployment
+	runner := jobs.NewRunner(10)
+
+	workerMux := http.NewServeMux()
+	registerWorkerHandlers(context.Background(), workerMux, runner, newSweepFactory(persister, pds.Client()))
+
+	worker := httptest.NewServer(workerMux)
+	defer worker.Close()
+
+	servicePolicy := bluesky.NewServicePolicy(nil, nil, true)
+
+	manager := httptest.NewServer(newConfigurationSweepHandler(
+		persister,
+
+		servicePolicy,
+		servicePolicy.NewHTTPClient(),
+
+		newSweepCooldowns(time.Hour),
+		newWorkerSweepTrigger(worker.Client(), worker.URL, "workersecret"),
+	))
+	defer manager.Close()
+
+	accessJwt, _ := pds.CreateSession(did)
+
+	var sweep ConfigurationSweep
+	requestSweep := func() *http.Response {
+		req, err := http.NewRequest(http.MethodPost, manager.URL+"?service="+url.QueryEscape(pds.URL), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+accessJwt)
+
+		res, err := manager.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusAccepted {
+			if err := json.NewDecoder(res.Body).Decode(&sweep); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return res
+	}
+
+	if res := requestSweep(); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %v for sweep, want %v", res.StatusCode, http.StatusAccepted)
+	}
+
+	runs := runner.List()
+	if len(runs) != 1 || runs[0].DID != did {
+		t.Fatalf("got runs %+v, want one run for %v", runs, did)
+	}
+
+	// The worker's job is passed through so that callers can tell which sweep they have queued
+	if sweep.JobID != runs[0].ID {
+		t.Fatalf("got job ID %q, want the worker's job %q", sweep.JobID, runs[0].ID)
+	}
+
+	job, _ := runner.Get(runs[0].ID)
+	select {
+	case <-job.Done():
+	case <-time.After(time.Second * 10):
+		t.Fatal("sweep did not finish")
+	}
+
+	if len(pds.Posts(did)) != 1 || len(pds.Posts(otherDID)) != 1 {
+		t.Fatalf("got %v and %v remaining posts, want only the caller's expired posts to be deleted", len(pds.Posts(did)), len(pds.Posts(otherDID)))
+	}
+
+	res := requestSweep()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %v for sweep within cooldown, want %v", res.StatusCode, http.StatusTooManyRequests)
+	}
+
+	if res.Header.Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+
+	if len(runner.List()) != 1 {
+		t.Fatal("sweep within cooldown has been queued")
+	}
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/persisters"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	autoMigrateFlag = "auto-migrate"
+)
+
+var (
+	errCouldNotMigrate = errors.New("could not migrate database")
+)
+
+type SchemaVersion struct {
+	Version         int64 `json:"version"`
+	ExpectedVersion int64 `json:"expectedVersion"`
+	UpToDate        bool  `json:"upToDate"`
+}
+
+// prepareSchema applies pending migrations if autoMigrate is set; otherwise, it only verifies
+// that the schema is at the expected version so that the server refuses to run against an outdated one
+func prepareSchema(
+	ctx context.Context,
+
+	migrate func(ctx context.Context) error,
+	ready func(ctx context.Context) (int64, error),
+
+	autoMigrate bool,
+) error {
+	if autoMigrate {
+		if err := migrate(ctx); err != nil {
+			return fmt.Errorf("%w: %v", errCouldNotMigrate, err)
+		}
+	}
+
+	version, err := ready(ctx)
+	if err != nil {
+		if errors.Is(err, persisters.ErrSchemaOutdated) {
+			return fmt.Errorf("%w; run `skysweeper-server migrate up` or pass --%v", err, autoMigrateFlag)
+		}
+
+		return err
+	}
+
+	slog.Info("Schema is up to date", "version", version)
+
+	return nil
+}
+
+// runMigrator opens a migrator for the duration of fn
+func runMigrator(cmd *cobra.Command, fn func(ctx context.Context, migrator *persisters.Migrator) error) error {
+	if err := viper.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	migrator := persisters.NewMigrator(viper.GetString(databaseURLFlag))
+
+	if err := migrator.Open(); err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	return fn(cmd.Context(), migrator)
+}
+
+var migrateCmd = &cobra.Command{
+	Use:     "migrate",
+	Aliases: []string{"m"},
+	Short:   "Apply, roll back and inspect database migrations",
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply all pending migrations",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runMigrator(cmd, func(ctx context.Context, migrator *persisters.Migrator) error {
+			return migrator.Up(ctx)
+		})
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Roll back the latest applied migration",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runMigrator(cmd, func(ctx context.Context, migrator *persisters.Migrator) error {
+			return migrator.Down(ctx)
+		})
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show which migrations have been applied",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runMigrator(cmd, func(ctx context.Context, migrator *persisters.Migrator) error {
+			statuses, err := migrator.Status(ctx)
+			if err != nil {
+				return err
+			}
+
+			return writeOutput(os.Stdout, viper.GetString(outputFlag), statuses, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "VERSION\tMIGRATION\tAPPLIED AT")
+
+				for _, status := range statuses {
+					appliedAt := "Pending"
+					if status.Applied && status.AppliedAt != nil {
+						appliedAt = status.AppliedAt.Format(time.RFC3339)
+					}
+
+					fmt.Fprintf(tw, "%v\t%v\t%v\n", status.Version, status.Source, appliedAt)
+				}
+			})
+		})
+	},
+}
+
+var migrateVersionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Show the schema version of the database and the version expected by this binary",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runMigrator(cmd, func(ctx context.Context, migrator *persisters.Migrator) error {
+			version, expectedVersion, err := migrator.Version(ctx)
+			if err != nil {
+				return err
+			}
+
+			schemaVersion := SchemaVersion{
+				Version:         version,
+				ExpectedVersion: expectedVersion,
+				UpToDate:        version == expectedVersion,
+			}
+
+			return writeOutput(os.Stdout, viper.GetString(outputFlag), schemaVersion, func(tw *tabwriter.Writer) {
+				fmt.Fprintln(tw, "VERSION\tEXPECTED VERSION\tUP TO DATE")
+				fmt.Fprintf(tw, "%v\t%v\t%v\n", schemaVersion.Version, schemaVersion.ExpectedVersion, schemaVersion.UpToDate)
+			})
+		})
+	},
+}
+
+func init() {
+	migrateCmd.PersistentFlags().StringP(outputFlag, "o", outputTable, "Output format (table or json)")
+
+	migrateCmd.AddCommand(
+		migrateUpCmd,
+		migrateDownCmd,
+		migrateStatusCmd,
+		migrateVersionCmd,
+	)
+
+	viper.AutomaticEnv()
+
+	rootCmd.AddCommand(migrateCmd)
+}
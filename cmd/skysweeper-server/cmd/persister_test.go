@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/models"
+)
+
+// memoryPersister implements the queries of the manager and worker persisters in memory
+type memoryPersister struct {
+	lock           sync.Mutex
+	configurations map[string]models.Configuration
+}
+
+func newMemoryPersister(configurations ...models.Configuration) *memoryPersister {
+	p := &memoryPersister{
+		configurations: map[string]models.Configuration{},
+	}
+
+	for _, c := range configurations {
+		p.configurations[c.Did] = c
+	}
+
+	return p
+}
+
+func (p *memoryPersister) get(did string) (models.Configuration, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.configurations[did]
+
+	return c, ok
+}
+
+func (p *memoryPersister) GetConfiguration(ctx context.Context, did string) (models.Configuration, error) {
+	c, ok := p.get(did)
+	if !ok {
+		return models.Configuration{}, sql.ErrNoRows
+	}
+
+	return c, nil
+}
+
+func (p *memoryPersister) UpsertConfiguration(ctx context.Context, did string, service string, refreshJWT string, enabled bool, postTtl int32) (models.Configuration, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c := models.Configuration{
+		Did:        did,
+		Service:    service,
+		RefreshJwt: refreshJWT,
+		Enabled:    enabled,
+		PostTtl:    postTtl,
+	}
+	p.configurations[did] = c
+
+	return c, nil
+}
+
+func (p *memoryPersister) PatchConfiguration(ctx context.Context, did string, service string, refreshJWT string, enabled *bool, postTtl *int32) (models.Configuration, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.configurations[did]
+	if !ok {
+		return models.Configuration{}, sql.ErrNoRows
+	}
+
+	c.Service = service
+	c.RefreshJwt = refreshJWT
+	c.DisabledByFailure = false
+
+	if enabled != nil {
+		c.Enabled = *enabled
+	}
+
+	if postTtl != nil {
+		if *postTtl < c.PostTtl {
+			c.Cursor = ""
+		}
+
+		c.PostTtl = *postTtl
+	}
+
+	p.configurations[did] = c
+
+	return c, nil
+}
+
+func (p *memoryPersister) DeleteConfiguration(ctx context.Context, did string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.configurations, did)
+
+	return nil
+}
+
+func (p *memoryPersister) GetEnabledConfigurations(ctx context.Context) ([]models.Configuration, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	configurations := []models.Configuration{}
+	for _, c := range p.configurations {
+		if c.Enabled {
+			configurations = append(configurations, c)
+		}
+	}
+
+	return configurations, nil
+}
+
+func (p *memoryPersister) DisableConfiguration(ctx context.Context, did string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c, ok := p.configurations[did]; ok {
+		c.Enabled = false
+		c.DisabledByFailure = true
+
+		p.configurations[did] = c
+	}
+
+	return nil
+}
+
+func (p *memoryPersister) UpdateRefreshTokenAndCursor(ctx context.Context, did string, cursor string, refreshJWT string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c, ok := p.configurations[did]; ok {
+		c.Cursor = cursor
+		c.RefreshJwt = refreshJWT
+
+		p.configurations[did] = c
+	}
+
+	return nil
+}
+
+func (p *memoryPersister) UpdateService(ctx context.Context, did string, service string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c, ok := p.configurations[did]; ok {
+		c.Service = service
+
+		p.configurations[did] = c
+	}
+
+	return nil
+}
+
+func (p *memoryPersister) UpdateSweepStatistics(ctx context.Context, did string, pointsSpent int, backlogPending bool, postsPending int, sweptPosts int, sweptAt time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c, ok := p.configurations[did]; ok {
+		c.PointsSpent += int64(pointsSpent)
+		c.BacklogPending = backlogPending
+		c.PostsPending = int64(postsPending)
+		c.LastSweptPosts = int64(sweptPosts)
+		c.LastSweptAt = sql.NullTime{Time: sweptAt, Valid: true}
+
+		p.configurations[did] = c
+	}
+
+	return nil
+}
+
+func (p *memoryPersister) GetConfigurationsPage(ctx context.Context, after string, limit int32) ([]models.Configuration, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	dids := []string{}
+	for did := range p.configurations {
+		if did > after {
+			dids = append(dids, did)
+		}
+	}
+	sort.Strings(dids)
+
+	configurations := []models.Configuration{}
+	for _, did := range dids {
+		if len(configurations) >= int(limit) {
+			break
+		}
+
+		configurations = append(configurations, p.configurations[did])
+	}
+
+	return configurations, nil
+}
+
+func (p *memoryPersister) SetConfigurationEnabled(ctx context.Context, did string, enabled bool) (models.Configuration, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.configurations[did]
+	if !ok {
+		return models.Configuration{}, sql.ErrNoRows
+	}
+
+	c.Enabled = enabled
+	c.DisabledByFailure = false
+
+	p.configurations[did] = c
+
+	return c, nil
+}
+
+func (p *memoryPersister) CountConfigurations(ctx context.Context) (models.CountConfigurationsRow, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	counts := models.CountConfigurationsRow{}
+	for _, c := range p.configurations {
+		counts.Total++
+
+		if c.Enabled {
+			counts.Enabled++
+		}
+
+		if c.DisabledByFailure {
+			counts.DisabledByFailure++
+		}
+	}
+
+	return counts, nil
+}
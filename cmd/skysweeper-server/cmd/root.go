@@ -1,19 +1,26 @@
 package cmd
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/pojntfx/skysweeper/pkg/logging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 const (
+	databaseURLFlag = "database-url"
 	postgresURLFlag = "postgres-url"
 	laddrFlag       = "laddr"
+
+	shutdownTimeoutFlag = "shutdown-timeout"
+
+	logFormatFlag = "log-format"
+	logLevelFlag  = "log-level"
 )
 
 var rootCmd = &cobra.Command{
@@ -30,14 +37,32 @@ https://github.com/pojntfx/skysweeper`,
 			return err
 		}
 
+		logLevel := viper.GetString(logLevelFlag)
+		if cmd.Flags().Lookup(verboseFlag) != nil && viper.GetBool(verboseFlag) {
+			logLevel = slog.LevelDebug.String()
+		}
+
+		logger, err := logging.New(os.Stderr, viper.GetString(logFormatFlag), logLevel)
+		if err != nil {
+			return err
+		}
+
+		slog.SetDefault(logger)
+
+		if v := viper.GetString(postgresURLFlag); v != "" {
+			slog.Warn("The --postgres-url flag is deprecated, please use --database-url instead")
+
+			viper.Set(databaseURLFlag, v)
+		}
+
 		if v := os.Getenv("DATABASE_URL"); v != "" {
-			log.Println("Using database address from DATABASE_URL env variable")
+			slog.Info("Using database address from DATABASE_URL env variable")
 
-			viper.Set(postgresURLFlag, v)
+			viper.Set(databaseURLFlag, v)
 		}
 
 		if v := os.Getenv("PORT"); v != "" {
-			log.Println("Using port from PORT env variable")
+			slog.Info("Using port from PORT env variable")
 
 			la, err := net.ResolveTCPAddr("tcp", viper.GetString(laddrFlag))
 			if err != nil {
@@ -58,7 +83,13 @@ https://github.com/pojntfx/skysweeper`,
 }
 
 func Execute() error {
-	rootCmd.PersistentFlags().String(postgresURLFlag, "postgresql://postgres@localhost:5432/skysweeper?sslmode=disable", "PostgreSQL URL (can also be set using `DATABASE_URL` env variable)")
+	rootCmd.PersistentFlags().String(databaseURLFlag, "postgresql://postgres@localhost:5432/skysweeper?sslmode=disable", "Database URL; the backend is detected from its scheme (postgres:// or postgresql:// for PostgreSQL, sqlite:// for SQLite, e.g. sqlite:///var/lib/skysweeper/skysweeper.db; can also be set using `DATABASE_URL` env variable)")
+	rootCmd.PersistentFlags().String(postgresURLFlag, "", "PostgreSQL URL")
+	if err := rootCmd.PersistentFlags().MarkDeprecated(postgresURLFlag, "use --database-url instead"); err != nil {
+		return err
+	}
+	rootCmd.PersistentFlags().String(logFormatFlag, logging.FormatText, "Log format to use (text or json)")
+	rootCmd.PersistentFlags().String(logLevelFlag, slog.LevelInfo.String(), "Log level to use (DEBUG, INFO, WARN or ERROR)")
 
 	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
 		return err
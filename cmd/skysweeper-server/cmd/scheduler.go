@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+)
+
+// runScheduler starts a sweep immediately and then every interval until ctx is cancelled, so that fresh
+// deployments don't wait a whole interval before their first sweep; if a sweep of all DIDs is still running
+// when the next one is due, the running one is kept instead of starting another one, and if a sweep of a
+// single DID is running, the scheduled sweep is started once it has finished
+func runScheduler(
+	ctx context.Context,
+
+	runner *jobs.Runner,
+	sweep func(ctx context.Context, job *jobs.Job) error,
+
+	interval time.Duration,
+) {
+	startScheduledSweep(ctx, runner, sweep)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			startScheduledSweep(ctx, runner, sweep)
+		}
+	}
+}
+
+// startScheduledSweep starts sweep, waiting for running sweeps of single DIDs to finish first
+func startScheduledSweep(
+	ctx context.Context,
+
+	runner *jobs.Runner,
+	sweep func(ctx context.Context, job *jobs.Job) error,
+) {
+	for {
+		job, created, err := runner.Start(ctx, sweep)
+		if err == nil {
+			if created {
+				slog.Info("Started scheduled sweep", "job", job.ID())
+			} else {
+				slog.Info("Sweep is still running, skipping scheduled sweep", "job", job.ID())
+			}
+
+			return
+		}
+
+		slog.Info("Sweep of a single DID is running, waiting for it to finish before starting scheduled sweep", "job", job.ID())
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-job.Done():
+		}
+	}
+}
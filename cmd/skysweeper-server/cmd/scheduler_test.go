@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+)
+
+func TestSchedulerStartsSweepOnceSweepOfSingleDIDHasFinished(t *testing.T) {
+	runner := jobs.NewRunner(10)
+
+	release := make(chan struct{})
+	single, _, err := runner.StartDID(context.Background(), "did:plc:alice", func(ctx context.Context, job *jobs.Job) error {
+		<-release
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swept := make(chan struct{})
+	scheduled := make(chan struct{})
+	go func() {
+		defer close(scheduled)
+
+		startScheduledSweep(context.Background(), runner, func(ctx context.Context, job *jobs.Job) error {
+			close(swept)
+
+			return nil
+		})
+	}()
+
+	select {
+	case <-swept:
+		t.Fatal("scheduled sweep has been started while sweep of single DID is running")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+	<-single.Done()
+
+	select {
+	case <-swept:
+	case <-time.After(time.Second * 10):
+		t.Fatal("scheduled sweep has not been started after sweep of single DID has finished")
+	}
+
+	<-scheduled
+}
+
+func TestSchedulerStartsSweepAtStartup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	swept := make(chan struct{}, 1)
+	go runScheduler(ctx, jobs.NewRunner(10), func(ctx context.Context, job *jobs.Job) error {
+		swept <- struct{}{}
+
+		return nil
+	}, time.Hour)
+
+	select {
+	case <-swept:
+	case <-time.After(time.Second * 10):
+		t.Fatal("no sweep has been started at startup")
+	}
+}
@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pojntfx/skysweeper/frontend"
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+	"github.com/pojntfx/skysweeper/pkg/metrics"
+	"github.com/pojntfx/skysweeper/pkg/persisters"
+	"github.com/pojntfx/skysweeper/pkg/tracing"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	sweepIntervalFlag = "sweep-interval"
+	frontendFlag      = "frontend"
+
+	frontendEmbedded = "embedded"
+)
+
+var (
+	errInvalidFrontendDirectory = errors.New("invalid frontend directory")
+)
+
+// openFrontend returns the PWA to serve for the value of the `--frontend` flag, which is either empty
+// to not serve it, "embedded" to serve the embedded PWA or the path to a directory containing it
+func openFrontend(frontendFlagValue string) (fs.FS, error) {
+	switch frontendFlagValue {
+	case "":
+		return nil, nil
+
+	case frontendEmbedded:
+		return frontend.FS()
+
+	default:
+		info, err := os.Stat(frontendFlagValue)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidFrontendDirectory, err)
+		}
+
+		if !info.IsDir() {
+			return nil, errInvalidFrontendDirectory
+		}
+
+		return os.DirFS(frontendFlagValue), nil
+	}
+}
+
+var serveCmd = &cobra.Command{
+	Use:     "serve",
+	Aliases: []string{"s"},
+	Short:   "Start an SkySweeper manager, worker and scheduler in one process and optionally serve the frontend",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := viper.BindPFlags(cmd.PersistentFlags()); err != nil {
+			return err
+		}
+
+		// Cancelling ctx stops the scheduler and sweeps between batches, after which their progress is saved
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		pwa, err := openFrontend(viper.GetString(frontendFlag))
+		if err != nil {
+			return err
+		}
+
+		if adminToken := viper.GetString(adminTokenFlag); adminToken != "" && adminToken == viper.GetString(apiKeyFlag) {
+			return errAdminTokenIsAPIKey
+		}
+
+		shutdownTracing, err := tracing.Open(ctx, viper.GetString(otlpEndpointFlag), "skysweeper-server")
+		if err != nil {
+			return err
+		}
+		defer shutdownTracing(context.Background())
+
+		// The manager and the worker share one connection pool, which SQLite requires to serialize writes
+		persister := persisters.NewManagerPersister(viper.GetString(databaseURLFlag))
+
+		if err := persister.Open(); err != nil {
+			return err
+		}
+		defer persister.Close()
+
+		slog.Info("Connected to database", "backend", persister.Backend())
+
+		if err := prepareSchema(ctx, persister.Migrate, persister.Ready, viper.GetBool(autoMigrateFlag)); err != nil {
+			return err
+		}
+
+		lis, err := net.Listen("tcp", viper.GetString(laddrFlag))
+		if err != nil {
+			return err
+		}
+		defer lis.Close()
+
+		slog.Info("Listening", "laddr", lis.Addr().String())
+
+		servicePolicy := newServicePolicy()
+		serviceClient := servicePolicy.NewHTTPClient()
+		serviceClient.Transport = metrics.NewTransport(serviceClient.Transport, viper.GetStringSlice(serviceAllowlistFlag))
+
+		if err := metrics.RegisterConfigurationsCollector(persister.CountConfigurations); err != nil {
+			return err
+		}
+
+		workerPersister := persister.Worker()
+
+		// Sweeps follow PDS endpoints from DID documents, which are controlled by users too
+		newDIDSweep := newSweepFactory(workerPersister, serviceClient)
+
+		runner := jobs.NewRunner(viper.GetInt(jobsRetainFlag))
+
+		mux := http.NewServeMux()
+
+		mux.Handle("/metrics", metrics.Handler())
+
+		registerHealthHandlers(mux, persister.Ready, runner.Running)
+
+		mux.Handle("/configuration", newConfigurationHandler(persister, servicePolicy, serviceClient))
+
+		registerConfigurationSweepHandler(mux, persister, servicePolicy, serviceClient, newRunnerSweepTrigger(ctx, runner, newDIDSweep))
+
+		if strings.TrimSpace(viper.GetString(apiKeyFlag)) == "" {
+			slog.Info("No API key set, not serving the worker endpoints; sweeps can only be started by the scheduler")
+		} else {
+			registerWorkerHandlers(ctx, mux, runner, newDIDSweep)
+		}
+
+		if strings.TrimSpace(viper.GetString(adminTokenFlag)) == "" {
+			slog.Info("No admin token set, not serving the admin API")
+		} else {
+			registerAdminHandlers(ctx, mux, workerPersister.Admin(), runner, newDIDSweep)
+		}
+
+		if pwa == nil {
+			slog.Info("Not serving the frontend")
+		} else {
+			mux.Handle("/", http.FileServer(http.FS(pwa)))
+
+			slog.Info("Serving the frontend", "frontend", viper.GetString(frontendFlag))
+		}
+
+		if interval := viper.GetDuration(sweepIntervalFlag); interval > 0 {
+			slog.Info("Scheduling sweeps", "interval", interval.String())
+
+			go runScheduler(ctx, runner, newDIDSweep(""), interval)
+		} else {
+			slog.Info("Sweep interval is zero, not scheduling sweeps")
+		}
+
+		serveErr := serve(ctx, lis, mux, viper.GetDuration(shutdownTimeoutFlag))
+
+		// Sweeps run independently of requests, so wait for them to save their progress too
+		waitCtx, cancelWait := context.WithTimeout(context.Background(), viper.GetDuration(shutdownTimeoutFlag))
+		defer cancelWait()
+
+		if err := runner.Wait(waitCtx); err != nil {
+			slog.Warn("Could not wait for running sweep to finish", "err", err)
+		}
+
+		return serveErr
+	},
+}
+
+func init() {
+	serveCmd.PersistentFlags().String(laddrFlag, ":1337", "Listen address")
+	serveCmd.PersistentFlags().Duration(shutdownTimeoutFlag, time.Minute, "Time to wait for in-flight requests and sweeps to finish when shutting down")
+	serveCmd.PersistentFlags().Bool(autoMigrateFlag, false, "Whether to apply pending migrations on startup (if false, the server only verifies the schema version and refuses to start if it is outdated; see the migrate command)")
+	serveCmd.PersistentFlags().String(apiKeyFlag, "", "API key to check incoming requests to the worker endpoints for (if empty, the worker endpoints are disabled)")
+	serveCmd.PersistentFlags().String(adminTokenFlag, "", "Admin token to check incoming requests to the admin API for (must differ from the API key; if empty, the admin API is disabled)")
+
+	addConfigurationFlags(serveCmd.PersistentFlags())
+	addSweepFlags(serveCmd.PersistentFlags())
+
+	serveCmd.PersistentFlags().Duration(sweepIntervalFlag, time.Hour*24, "Interval in which to start sweeps, starting with one at startup (if zero, sweeps are only started using the worker endpoints)")
+
+	serveCmd.PersistentFlags().String(frontendFlag, "", "Frontend to serve (if empty, no frontend is served; if embedded, the frontend embedded with -tags embed_frontend is served; otherwise, the directory with the path is served)")
+
+	serveCmd.PersistentFlags().String(plcDirectoryURLFlag, "https://plc.directory", "PLC directory URL to resolve did:plc DID documents with (used to validate services and follow PDS migrations)")
+
+	serveCmd.PersistentFlags().String(otlpEndpointFlag, "", "OTLP/HTTP collector endpoint to export traces to (e.g. http://localhost:4318; if empty, tracing is disabled)")
+
+	serveCmd.PersistentFlags().Bool(verboseFlag, false, "Whether to enable verbose logging (shorthand for --log-level DEBUG)")
+
+	viper.AutomaticEnv()
+
+	rootCmd.AddCommand(serveCmd)
+}
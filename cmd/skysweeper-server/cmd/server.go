@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serve serves handler on lis until ctx is cancelled, after which it stops accepting
+// new connections and waits up to shutdownTimeout for in-flight requests to finish
+func serve(
+	ctx context.Context,
+
+	lis net.Listener,
+	handler http.Handler,
+
+	shutdownTimeout time.Duration,
+) error {
+	srv := &http.Server{
+		Handler: handler,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(lis)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down gracefully", "timeout", shutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		_ = srv.Close()
+
+		return err
+	}
+
+	if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
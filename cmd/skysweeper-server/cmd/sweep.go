@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/models"
+	"github.com/pojntfx/skysweeper/pkg/sweeper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	handleFlag      = "handle"
+	appPasswordFlag = "app-password"
+	accessJWTFlag   = "access-jwt"
+	serviceFlag     = "service"
+	postTTLFlag     = "post-ttl"
+	stateFileFlag   = "state-file"
+)
+
+var (
+	errMissingCredentials = errors.New("missing credentials, set --handle and --app-password or --access-jwt")
+	errInvalidPostTTL     = errors.New("invalid post TTL, must be at least 1 month")
+
+	errCouldNotLogIn      = errors.New("could not log in")
+	errCouldNotReadState  = errors.New("could not read state file")
+	errCouldNotWriteState = errors.New("could not write state file")
+)
+
+// SweepState is kept in the state file between one-shot sweeps
+type SweepState struct {
+	Accounts map[string]SweepAccountState `json:"accounts"`
+}
+
+type SweepAccountState struct {
+	Cursor  string `json:"cursor"`
+	PostTTL int    `json:"postTTL"`
+}
+
+// SweepReport is printed after a one-shot sweep
+type SweepReport struct {
+	DID          string `json:"did"`
+	Handle       string `json:"handle"`
+	DryRun       bool   `json:"dryRun"`
+	PostsExpired int    `json:"postsExpired"`
+	PostsDeleted int    `json:"postsDeleted"`
+	Cursor       string `json:"cursor"`
+	SpentPoints  int    `json:"spentPoints"`
+	Duration     string `json:"duration"`
+}
+
+func readSweepState(path string) (SweepState, error) {
+	state := SweepState{
+		Accounts: map[string]SweepAccountState{},
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+
+		return SweepState{}, fmt.Errorf("%w: %v", errCouldNotReadState, err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return SweepState{}, fmt.Errorf("%w: %v", errCouldNotReadState, err)
+	}
+
+	if state.Accounts == nil {
+		state.Accounts = map[string]SweepAccountState{}
+	}
+
+	return state, nil
+}
+
+// writeSweepState replaces the state file atomically so that an interrupted write doesn't lose the cursor
+func writeSweepState(path string, state SweepState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("%w: %v", errCouldNotWriteState, err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCouldNotWriteState, err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := json.NewEncoder(f).Encode(state); err != nil {
+		_ = f.Close()
+
+		return fmt.Errorf("%w: %v", errCouldNotWriteState, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: %v", errCouldNotWriteState, err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("%w: %v", errCouldNotWriteState, err)
+	}
+
+	return nil
+}
+
+// logIn creates a session with the handle and app password if they are set, or uses the access token
+// of an existing session otherwise
+func logIn(ctx context.Context, client *xrpc.Client, handle, appPassword, accessJWT string) (*xrpc.AuthInfo, error) {
+	if strings.TrimSpace(handle) != "" && strings.TrimSpace(appPassword) != "" {
+		session, err := atproto.ServerCreateSession(ctx, client, &atproto.ServerCreateSession_Input{
+			Identifier: handle,
+			Password:   appPassword,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCouldNotLogIn, err)
+		}
+
+		return &xrpc.AuthInfo{
+			AccessJwt:  session.AccessJwt,
+			RefreshJwt: session.RefreshJwt,
+			Handle:     session.Handle,
+			Did:        session.Did,
+		}, nil
+	}
+
+	if strings.TrimSpace(accessJWT) == "" {
+		return nil, errMissingCredentials
+	}
+
+	client.Auth = &xrpc.AuthInfo{
+		AccessJwt: accessJWT,
+	}
+
+	session, err := atproto.ServerGetSession(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCouldNotLogIn, err)
+	}
+
+	return &xrpc.AuthInfo{
+		AccessJwt: accessJWT,
+		Handle:    session.Handle,
+		Did:       session.Did,
+	}, nil
+}
+
+// sweepStatePersister keeps the cursor of the account of a one-shot sweep in the state file; in dry run mode, nothing is saved
+type sweepStatePersister struct {
+	path  string
+	state SweepState
+
+	configuration models.Configuration
+
+	dryRun bool
+}
+
+func (p *sweepStatePersister) GetConfiguration(ctx context.Context, did string) (models.Configuration, error) {
+	if did != p.configuration.Did {
+		return models.Configuration{}, sql.ErrNoRows
+	}
+
+	return p.configuration, nil
+}
+
+func (p *sweepStatePersister) GetEnabledConfigurations(ctx context.Context) ([]models.Configuration, error) {
+	return []models.Configuration{p.configuration}, nil
+}
+
+// DisableConfiguration does nothing since there is no configuration to disable
+func (p *sweepStatePersister) DisableConfiguration(ctx context.Context, did string) error {
+	return nil
+}
+
+// UpdateRefreshTokenAndCursor only saves the cursor, since the next sweep logs in again
+func (p *sweepStatePersister) UpdateRefreshTokenAndCursor(ctx context.Context, did string, cursor string, refreshJWT string) error {
+	if p.dryRun {
+		return nil
+	}
+
+	p.state.Accounts[did] = SweepAccountState{
+		Cursor:  cursor,
+		PostTTL: int(p.configuration.PostTtl),
+	}
+
+	if err := writeSweepState(p.path, p.state); err != nil {
+		return err
+	}
+
+	p.configuration.Cursor = cursor
+
+	return nil
+}
+
+// UpdateService does nothing since the service is set with a flag
+func (p *sweepStatePersister) UpdateService(ctx context.Context, did string, service string) error {
+	return nil
+}
+
+// UpdateSweepStatistics does nothing since the cursor already tracks where the next run continues
+func (p *sweepStatePersister) UpdateSweepStatistics(ctx context.Context, did string, pointsSpent int, backlogPending bool, postsPending int, sweptPosts int, sweptAt time.Time) error {
+	return nil
+}
+
+// sessionClient sweeps with the session of a one-shot sweep instead of refreshing one
+type sessionClient struct {
+	*sweeper.PDSClient
+
+	service string
+	auth    *xrpc.AuthInfo
+}
+
+// ResolvePDS returns the service the session has been created with, since its tokens might not be valid for the PDS
+func (c *sessionClient) ResolvePDS(ctx context.Context, did string) (string, error) {
+	return c.service, nil
+}
+
+func (c *sessionClient) RefreshSession(ctx context.Context, service string, refreshJWT string) (*xrpc.AuthInfo, error) {
+	return c.auth, nil
+}
+
+// sweepAccount deletes the expired posts of the account client is authenticated as, starting at the cursor
+// in the state file; the cursor is saved after each page, so an interrupted sweep resumes at the page it
+// stopped at, while a dry run lists the same posts again next time
+func sweepAccount(
+	ctx context.Context,
+
+	client *xrpc.Client,
+
+	postTTL int,
+	statePath string,
+
+	dryRun bool,
+) (SweepReport, error) {
+	report := SweepReport{
+		DID:    client.Auth.Did,
+		Handle: client.Auth.Handle,
+		DryRun: dryRun,
+	}
+
+	state, err := readSweepState(statePath)
+	if err != nil {
+		return report, err
+	}
+
+	account := state.Accounts[client.Auth.Did]
+
+	// Posts which weren't expired before might be now, so rescan the repo
+	if postTTL < account.PostTTL {
+		slog.Info("Post TTL has been decreased, resetting cursor", "from", account.PostTTL, "to", postTTL)
+
+		account.Cursor = ""
+	}
+
+	persister := &sweepStatePersister{
+		path:  statePath,
+		state: state,
+
+		configuration: models.Configuration{
+			Did:     client.Auth.Did,
+			Service: client.Host,
+			Enabled: true,
+			PostTtl: int32(postTTL),
+			Cursor:  account.Cursor,
+		},
+
+		dryRun: dryRun,
+	}
+
+	options := newSweepOptions()
+	options.DryRun = dryRun
+
+	s := sweeper.NewSweeper(persister, &sessionClient{
+		PDSClient: sweeper.NewPDSClient(client.Client, "", nil), // The service is set by the operator with a flag
+
+		service: client.Host,
+		auth:    client.Auth,
+	}, options)
+
+	var didErr error
+	result, err := s.Sweep(ctx, client.Auth.Did, sweeper.Hooks{
+		OnDIDFinished: func(did string, progress sweeper.Progress, err error) {
+			didErr = err
+		},
+	})
+
+	report.PostsExpired = result.PostsListed
+	if !dryRun {
+		report.PostsDeleted = result.PostsDeleted
+	}
+	report.Cursor = persister.configuration.Cursor
+	report.SpentPoints = result.SpentPoints
+	report.Duration = result.Duration.String()
+
+	if err != nil {
+		return report, err
+	}
+
+	return report, didErr
+}
+
+var sweepCmd = &cobra.Command{
+	Use:   "sweep",
+	Short: "Delete the expired posts of a single account once, without a manager or database",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := viper.BindPFlags(cmd.PersistentFlags()); err != nil {
+			return err
+		}
+
+		// Cancelling ctx stops the sweep between batches; the cursor of the last committed page is kept, so the next run resumes there
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		postTTL := viper.GetInt(postTTLFlag)
+		if postTTL < 1 {
+			return errInvalidPostTTL
+		}
+
+		statePath := viper.GetString(stateFileFlag)
+		if statePath == "" {
+			configDir, err := os.UserConfigDir()
+			if err != nil {
+				return err
+			}
+
+			statePath = filepath.Join(configDir, "skysweeper", "sweep-state.json")
+		}
+
+		client := &xrpc.Client{
+			Client: &http.Client{},
+			Host:   viper.GetString(serviceFlag),
+		}
+
+		auth, err := logIn(
+			ctx,
+
+			client,
+
+			viper.GetString(handleFlag),
+			viper.GetString(appPasswordFlag),
+			viper.GetString(accessJWTFlag),
+		)
+		if err != nil {
+			return err
+		}
+
+		client.Auth = auth
+
+		slog.Info("Logged in", "did", auth.Did, "handle", auth.Handle)
+
+		report, sweepErr := sweepAccount(ctx, client, postTTL, statePath, viper.GetBool(dryRunFlag))
+
+		// Print the report even if the sweep has failed, since some posts might have been deleted already
+		if err := writeOutput(os.Stdout, viper.GetString(outputFlag), report, func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "DID\tHANDLE\tDRY RUN\tPOSTS EXPIRED\tPOSTS DELETED\tCURSOR\tSPENT POINTS\tDURATION")
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", report.DID, report.Handle, report.DryRun, report.PostsExpired, report.PostsDeleted, report.Cursor, report.SpentPoints, report.Duration)
+		}); err != nil {
+			return err
+		}
+
+		return sweepErr
+	},
+}
+
+func init() {
+	sweepCmd.PersistentFlags().String(handleFlag, "", "Handle or email to log in with (requires --app-password)")
+	sweepCmd.PersistentFlags().String(appPasswordFlag, "", "App password to log in with (see https://bsky.app/settings/app-passwords)")
+	sweepCmd.PersistentFlags().String(accessJWTFlag, "", "Access token of an existing session to use instead of logging in with a handle and app password")
+	sweepCmd.PersistentFlags().String(serviceFlag, "https://bsky.social", "Service (PDS or entryway) to log in to and delete posts from")
+
+	sweepCmd.PersistentFlags().Int(postTTLFlag, 6, "Age in months after which posts are deleted")
+	sweepCmd.PersistentFlags().String(stateFileFlag, "", "Path to the file to keep the cursor in between runs (if empty, skysweeper/sweep-state.json in the user's configuration directory is used)")
+
+	sweepCmd.PersistentFlags().Int(rateLimitPointsDIDFlag, 200, "Maximum amount of rate limit points to spend for listing and deleting posts; the rest of the posts is deleted in the next runs (see https://atproto.com/blog/rate-limits-pds-v3; must be less than 1666 per hour as of September 2023)")
+	sweepCmd.PersistentFlags().Int(rateLimitPointsGlobalFlag, 2500, "Maximum amount of rate limit points to spend per rate limit reset interval (see https://atproto.com/blog/rate-limits-pds-v3; must be less than 3000 per hour as of September 2023)")
+	sweepCmd.PersistentFlags().Duration(rateLimitResetIntervalFlag, time.Minute*5, "Duration of a rate limit reset interval (see https://atproto.com/blog/rate-limits-pds-v3; 5 minutes as of September 2023)")
+	sweepCmd.PersistentFlags().Int(listRecordsLimitFlag, 100, "Limit of records to return per API call (see https://atproto.com/blog/rate-limits-pds-v3; 100 as of September 2023)")
+	sweepCmd.PersistentFlags().Int(applyWritesLimitFlag, 10, "Limit of records to apply writes for per API call (see https://atproto.com/blog/rate-limits-pds-v3; 10 as of September 2023)")
+	sweepCmd.PersistentFlags().Bool(dryRunFlag, true, "Whether to do a dry run (only fetch for posts to be deleted without actually deleting them)")
+
+	sweepCmd.PersistentFlags().StringP(outputFlag, "o", outputTable, "Output format (table or json)")
+
+	sweepCmd.PersistentFlags().Bool(verboseFlag, false, "Whether to enable verbose logging (shorthand for --log-level DEBUG)")
+
+	viper.AutomaticEnv()
+
+	rootCmd.AddCommand(sweepCmd)
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/bluesky/bskytest"
+)
+
+func TestSweepDeletesExpiredPostsAndKeepsCursor(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	setupWorker(t, pds)
+
+	did := pds.AddAccount(testHandle, testPassword)
+	for _, age := range []time.Duration{expired, expired, expired, unexpired} {
+		pds.AddPost(did, time.Now().Add(-age))
+	}
+
+	client := &xrpc.Client{
+		Client: pds.Client(),
+		Host:   pds.URL,
+	}
+
+	auth, err := logIn(context.Background(), client, testHandle, testPassword, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Auth = auth
+
+	statePath := filepath.Join(t.TempDir(), "sweep-state.json")
+
+	report, err := sweepAccount(context.Background(), client, 1, statePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.PostsExpired != 3 || report.PostsDeleted != 0 || len(pds.Posts(did)) != 4 {
+		t.Fatalf("got report %+v and %v remaining posts, want 3 expired posts to be kept in dry run mode", report, len(pds.Posts(did)))
+	}
+
+	if state, err := readSweepState(statePath); err != nil || len(state.Accounts) != 0 {
+		t.Fatalf("got state %+v and error %v, want no state to be saved in dry run mode", state, err)
+	}
+
+	report, err = sweepAccount(context.Background(), client, 1, statePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.PostsDeleted != 3 || len(pds.Posts(did)) != 1 {
+		t.Fatalf("got report %+v and %v remaining posts, want 3 deleted posts", report, len(pds.Posts(did)))
+	}
+
+	state, err := readSweepState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account := state.Accounts[did]; account.Cursor == "" || account.Cursor != report.Cursor || account.PostTTL != 1 {
+		t.Fatalf("got account state %+v, want the cursor from report %+v and a post TTL of 1", account, report)
+	}
+
+	// The next run resumes at the cursor and only lists the remaining unexpired post
+	listRecordsCalls := pds.Calls(bskytest.MethodListRecords)
+
+	report, err = sweepAccount(context.Background(), client, 1, statePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.PostsExpired != 0 || pds.Calls(bskytest.MethodListRecords)-listRecordsCalls != 1 {
+		t.Fatalf("got report %+v, want no expired posts after listing one page", report)
+	}
+}
+
+func TestSweepLogsInWithAccessToken(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	did := pds.AddAccount(testHandle, testPassword)
+	accessJwt, _ := pds.CreateSession(did)
+
+	auth, err := logIn(context.Background(), &xrpc.Client{
+		Client: pds.Client(),
+		Host:   pds.URL,
+	}, "", "", accessJwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth.Did != did || auth.Handle != testHandle || auth.AccessJwt != accessJwt {
+		t.Fatalf("got auth %+v, want the session of %v", auth, did)
+	}
+
+	if _, err := logIn(context.Background(), &xrpc.Client{
+		Client: pds.Client(),
+		Host:   pds.URL,
+	}, testHandle, "", ""); !errors.Is(err, errMissingCredentials) {
+		t.Fatalf("got error %v, want %v", err, errMissingCredentials)
+	}
+}
@@ -5,17 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/bluesky-social/indigo/api/atproto"
-	"github.com/bluesky-social/indigo/xrpc"
-	"github.com/pojntfx/skysweeper/pkg/bluesky"
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+	"github.com/pojntfx/skysweeper/pkg/logging"
+	"github.com/pojntfx/skysweeper/pkg/metrics"
 	"github.com/pojntfx/skysweeper/pkg/persisters"
+	"github.com/pojntfx/skysweeper/pkg/problems"
+	"github.com/pojntfx/skysweeper/pkg/sweeper"
+	"github.com/pojntfx/skysweeper/pkg/tracing"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -23,24 +30,39 @@ const (
 	apiKeyFlag = "api-key"
 
 	rateLimitPointsDIDFlag     = "rate-limit-points-did"
+	rateLimitPointsSweepFlag   = "rate-limit-points-sweep"
 	rateLimitPointsGlobalFlag  = "rate-limit-points-global"
 	rateLimitResetIntervalFlag = "rate-limit-reset-interval"
 	listRecordsLimitFlag       = "list-records-limit"
 	applyWritesLimitFlag       = "apply-writes-limit"
 	dryRunFlag                 = "dry-run"
 
+	plcDirectoryURLFlag = "plc-directory-url"
+	otlpEndpointFlag    = "otlp-endpoint"
+
+	jobsRetainFlag = "jobs-retain"
+
 	verboseFlag = "verbose"
 )
 
 var (
 	errMissingAPIKey = errors.New("missing API key")
+	errInvalidAPIKey = errors.New("invalid API key")
+
+	errJobNotFound = errors.New("job not found")
 )
 
-type Statistics struct {
-	SpentPoints  int `json:"spentPoints"`
-	SpentTime    int `json:"spentTime"`
-	Throttled    int `json:"throttled"`
-	PostsDeleted int `json:"postsDeleted"`
+func checkAPIKey(r *http.Request) error {
+	requestAPIKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.TrimSpace(requestAPIKey) == "" {
+		return problems.Unauthorized(errMissingAuthorization)
+	}
+
+	if requestAPIKey != viper.GetString(apiKeyFlag) {
+		return problems.Unauthorized(errInvalidAPIKey)
+	}
+
+	return nil
 }
 
 var workerCmd = &cobra.Command{
@@ -52,21 +74,36 @@ var workerCmd = &cobra.Command{
 			return err
 		}
 
-		ctx, cancel := context.WithCancel(context.Background())
+		// Cancelling ctx stops sweeps between batches, after which their progress is saved
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer cancel()
 
 		if strings.TrimSpace(viper.GetString(apiKeyFlag)) == "" {
 			return errMissingAPIKey
 		}
 
-		persister := persisters.NewWorkerPersister(viper.GetString(postgresURLFlag))
+		if adminToken := viper.GetString(adminTokenFlag); adminToken != "" && adminToken == viper.GetString(apiKeyFlag) {
+			return errAdminTokenIsAPIKey
+		}
+
+		shutdownTracing, err := tracing.Open(ctx, viper.GetString(otlpEndpointFlag), "skysweeper-worker")
+		if err != nil {
+			return err
+		}
+		defer shutdownTracing(context.Background())
+
+		persister := persisters.NewWorkerPersister(viper.GetString(databaseURLFlag))
 
 		if err := persister.Open(); err != nil {
 			return err
 		}
 		defer persister.Close()
 
-		log.Println("Connected to PostgreSQL")
+		slog.Info("Connected to database", "backend", persister.Backend())
+
+		if err := prepareSchema(ctx, persister.Migrate, persister.Ready, viper.GetBool(autoMigrateFlag)); err != nil {
+			return err
+		}
 
 		lis, err := net.Listen("tcp", viper.GetString(laddrFlag))
 		if err != nil {
@@ -74,190 +111,260 @@ var workerCmd = &cobra.Command{
 		}
 		defer lis.Close()
 
-		log.Println("Listening on", lis.Addr())
+		slog.Info("Listening", "laddr", lis.Addr().String())
 
-		mux := http.NewServeMux()
+		if err := metrics.RegisterConfigurationsCollector(persister.CountConfigurations); err != nil {
+			return err
+		}
 
-		mux.HandleFunc("/posts", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			requestAPIKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-			if strings.TrimSpace(requestAPIKey) == "" {
-				w.WriteHeader(http.StatusUnauthorized)
+		// DID documents are controlled by users, so the PDS endpoints they point to are restricted like in the manager
+		httpClient := newServicePolicy().NewHTTPClient()
+		httpClient.Transport = metrics.NewTransport(httpClient.Transport, viper.GetStringSlice(serviceAllowlistFlag))
 
-				return
-			}
+		newDIDSweep := newSweepFactory(persister, httpClient)
 
-			if requestAPIKey != viper.GetString(apiKeyFlag) {
-				w.WriteHeader(http.StatusUnauthorized)
+		runner := jobs.NewRunner(viper.GetInt(jobsRetainFlag))
 
-				return
-			}
+		mux := http.NewServeMux()
 
-			defer func() {
-				if err := recover(); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+		mux.Handle("/metrics", metrics.Handler())
 
-					log.Printf("Client disconnected with error: %v", err)
-				}
-			}()
+		registerHealthHandlers(mux, persister.Ready, runner.Running)
 
-			switch r.Method {
-			case http.MethodDelete:
-				throttled := 0
-				limiter := bluesky.NewLimiter(
-					ctx,
+		registerWorkerHandlers(ctx, mux, runner, newDIDSweep)
 
-					viper.GetInt(rateLimitPointsGlobalFlag),
-					viper.GetDuration(rateLimitResetIntervalFlag),
+		if strings.TrimSpace(viper.GetString(adminTokenFlag)) == "" {
+			slog.Info("No admin token set, not serving the admin API")
+		} else {
+			registerAdminHandlers(ctx, mux, persister.Admin(), runner, newDIDSweep)
+		}
 
-					func() error {
-						log.Println("Pausing until rate limit reset interval")
+		serveErr := serve(ctx, lis, mux, viper.GetDuration(shutdownTimeoutFlag))
 
-						throttled++
+		// Sweeps run independently of requests, so wait for them to save their progress too
+		waitCtx, cancelWait := context.WithTimeout(context.Background(), viper.GetDuration(shutdownTimeoutFlag))
+		defer cancelWait()
 
-						return nil
-					},
-				)
+		if err := runner.Wait(waitCtx); err != nil {
+			slog.Warn("Could not wait for running sweep to finish", "err", err)
+		}
 
-				go limiter.Open()
+		return serveErr
+	},
+}
 
-				before := time.Now()
+// registerWorkerHandlers adds the endpoints to start sweeps (`/posts`, optionally filtered with `?did=`) and
+// follow them (`/jobs/`) to mux; cancelling ctx stops running sweeps and event streams
+func registerWorkerHandlers(
+	ctx context.Context,
 
-				configurations, err := persister.GetEnabledConfigurations(ctx)
-				if err != nil {
-					panic(err)
-				}
+	mux *http.ServeMux,
 
-				postsDeleted := 0
-				for _, configuration := range configurations {
-					auth := &xrpc.AuthInfo{}
+	runner *jobs.Runner,
+	newDIDSweep sweepFactory,
+) {
+	mux.Handle("/posts", metrics.InstrumentHandler("posts", problems.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if err := checkAPIKey(r); err != nil {
+			return err
+		}
 
-					client := &xrpc.Client{
-						Client: http.DefaultClient,
-						Host:   configuration.Service,
-						Auth:   auth,
-					}
+		switch r.Method {
+		case http.MethodDelete:
+			did := r.URL.Query().Get("did")
 
-					auth.AccessJwt = configuration.RefreshJwt
-					auth.Did = configuration.Did
+			job, created, err := runner.StartDID(ctx, did, newDIDSweep(did))
+			if err != nil {
+				return problems.New(http.StatusServiceUnavailable, errSweepBusy, err)
+			}
 
-					session, err := atproto.ServerRefreshSession(ctx, client)
-					if err != nil {
-						log.Println("Could not refresh session for DID", auth.Did, ", disabling configuration and skipping:", err)
+			if created {
+				slog.Info("Started sweep", "job", job.ID(), "did", did)
+			} else {
+				slog.Info("Sweep is already running, returning existing job", "job", job.ID())
+			}
 
-						if err := persister.DisableConfiguration(ctx, auth.Did); err != nil {
-							log.Println("Could not disable configuration for DID", auth.Did, ", skipping:", err)
+			w.Header().Set("Location", "/jobs/"+job.ID())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
 
-							continue
-						}
+			if err := json.NewEncoder(w).Encode(job.Snapshot()); err != nil {
+				return fmt.Errorf("%w: %v", errCouldNotEncode, err)
+			}
 
-						continue
-					}
+		default:
+			w.Header().Set("Allow", "DELETE")
 
-					auth.AccessJwt = session.AccessJwt
-					auth.RefreshJwt = session.RefreshJwt
-					auth.Handle = session.Handle
-					auth.Did = session.Did
+			return problems.MethodNotAllowed(r.Method)
+		}
 
-					postsToDelete, cursor, err := bluesky.GetPostsToDelete(
-						client,
+		return nil
+	})))
 
-						int(configuration.PostTtl),
-						configuration.Cursor,
-						viper.GetInt(listRecordsLimitFlag), // Limit as per https://atproto.com/blog/rate-limits-pds-v3
-						viper.GetInt(rateLimitPointsDIDFlag),
+	mux.Handle("/jobs/", metrics.InstrumentHandler("jobs", problems.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if err := checkAPIKey(r); err != nil {
+			return err
+		}
 
-						limiter,
-					)
-					if err != nil {
-						log.Println("Could not get posts to delete for DID", auth.Did, ", skipping:", err)
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
 
-						continue
-					}
+			return problems.MethodNotAllowed(r.Method)
+		}
 
-					postsDeleted += len(postsToDelete)
+		id, subresource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
 
-					if err := bluesky.DeletePosts(
-						ctx,
+		job, ok := runner.Get(id)
+		if !ok {
+			return problems.NotFound(errJobNotFound)
+		}
 
-						client,
+		if subresource == "events" {
+			return streamJobEvents(ctx, w, r, job, r.URL.Query().Get("did"))
+		}
 
-						postsToDelete,
-						viper.GetInt(applyWritesLimitFlag),
+		if subresource != "" {
+			return problems.NotFound(errJobNotFound)
+		}
 
-						viper.GetBool(dryRunFlag),
+		w.Header().Set("Content-Type", "application/json")
 
-						limiter,
-					); err != nil {
-						log.Println("Could not delete posts for DID", auth.Did, ", skipping:", err)
+		if err := json.NewEncoder(w).Encode(job.Snapshot()); err != nil {
+			return fmt.Errorf("%w: %v", errCouldNotEncode, err)
+		}
 
-						continue
-					}
+		return nil
+	})))
+}
 
-					if err := persister.UpdateRefreshTokenAndCursor(
-						ctx,
-						auth.Did,
-						cursor,
-						auth.RefreshJwt,
-					); err != nil {
-						log.Println("Could not update refresh token and cursor for DID", auth.Did, ", skipping:", err)
+// sweepFactory returns a sweep for all enabled configurations if did is empty, or only for the configuration of did otherwise
+type sweepFactory func(did string) func(ctx context.Context, job *jobs.Job) error
 
-						continue
-					}
-				}
+func newSweepFactory(persister sweeper.Persister, httpClient *http.Client) sweepFactory {
+	return func(did string) func(ctx context.Context, job *jobs.Job) error {
+		return newSweep(persister, httpClient, did)
+	}
+}
 
-				res := &Statistics{
-					SpentPoints:  limiter.GetSpendPoints(),
-					SpentTime:    int(time.Since(before)),
-					Throttled:    throttled,
-					PostsDeleted: postsDeleted,
-				}
+// newSweepOptions returns the options of the sweep flags
+func newSweepOptions() sweeper.Options {
+	return sweeper.Options{
+		RateLimitPointsGlobal:  viper.GetInt(rateLimitPointsGlobalFlag),
+		RateLimitResetInterval: viper.GetDuration(rateLimitResetIntervalFlag),
+		RateLimitPointsDID:     viper.GetInt(rateLimitPointsDIDFlag),
+		RateLimitPointsSweep:   viper.GetInt(rateLimitPointsSweepFlag),
+		ListRecordsLimit:       viper.GetInt(listRecordsLimitFlag),
+		ApplyWritesLimit:       viper.GetInt(applyWritesLimitFlag),
+
+		DryRun: viper.GetBool(dryRunFlag),
+	}
+}
 
-				if viper.GetBool(verboseFlag) {
-					log.Println(
-						"Spent", res.SpentPoints,
-						"points in", res.SpentTime,
-						"while being throttled", res.Throttled,
-						"times to delete", postsDeleted,
-						"posts (dry run mode", func() string {
-							if viper.GetBool(dryRunFlag) {
-								return "enabled)"
-							}
-
-							return "disabled)"
-						}())
+// newSweep returns a function which deletes expired posts for all enabled configurations, or only for the
+// configuration of did if it is set, and reports its progress to the job; cancelling its context stops it between batches
+func newSweep(persister sweeper.Persister, httpClient *http.Client, did string) func(ctx context.Context, job *jobs.Job) error {
+	s := sweeper.NewSweeper(persister, sweeper.NewPDSClient(httpClient, viper.GetString(plcDirectoryURLFlag), newServicePolicy()), newSweepOptions())
+
+	return func(ctx context.Context, job *jobs.Job) error {
+		ctx, _ = logging.With(ctx, "run_id", job.ID())
+
+		result, err := s.Sweep(ctx, did, sweeper.Hooks{
+			OnStarted: func(dids int) {
+				job.Update(func(p *jobs.Progress) {
+					p.DIDsTotal = dids
+				})
+			},
+			OnThrottled: func() {
+				job.Update(func(p *jobs.Progress) {
+					p.Throttled++
+				})
+				job.Publish(jobs.Event{
+					Type: jobs.EventThrottled,
+				})
+			},
+			OnDIDStarted: func(did string) {
+				job.Publish(jobs.Event{
+					Type: jobs.EventDIDStarted,
+					DID:  did,
+				})
+			},
+			OnPostsListed: func(did string, posts int, progress sweeper.Progress) {
+				job.Publish(jobs.Event{
+					Type:         jobs.EventPostsListed,
+					DID:          did,
+					Posts:        posts,
+					PostsDeleted: progress.PostsDeleted,
+					PostsTotal:   progress.PostsTotal,
+				})
+			},
+			OnBatchDeleted: func(did string, posts int, progress sweeper.Progress) {
+				job.Update(func(p *jobs.Progress) {
+					p.PostsDeleted += posts
+					p.SpentPoints = progress.SpentPoints
+				})
+				job.Publish(jobs.Event{
+					Type:         jobs.EventBatchDeleted,
+					DID:          did,
+					Posts:        posts,
+					PostsDeleted: progress.PostsDeleted,
+					PostsTotal:   progress.PostsTotal,
+				})
+			},
+			OnDIDFinished: func(did string, progress sweeper.Progress, err error) {
+				job.Update(func(p *jobs.Progress) {
+					p.DIDsDone++
+					p.SpentPoints = progress.SpentPoints
+				})
+
+				event := jobs.Event{
+					Type:         jobs.EventDIDFinished,
+					DID:          did,
+					PostsDeleted: progress.PostsDeleted,
+					PostsTotal:   progress.PostsTotal,
 				}
-
-				w.Header().Set("Content-Type", "application/json")
-
-				if err := json.NewEncoder(w).Encode(res); err != nil {
-					panic(fmt.Errorf("%w: %v", errCouldNotEncode, err))
+				if err != nil {
+					event.Error = err.Error()
 				}
 
-			default:
-				w.WriteHeader(http.StatusMethodNotAllowed)
-			}
-		}))
+				job.Publish(event)
+			},
+		})
 
-		if err := http.Serve(lis, mux); err != nil {
-			return err
-		}
+		job.Update(func(p *jobs.Progress) {
+			p.SpentPoints = result.SpentPoints
+		})
 
-		return nil
-	},
+		return err
+	}
+}
+
+// addSweepFlags adds the flags which configure sweeps to flags
+func addSweepFlags(flags *pflag.FlagSet) {
+	flags.Int(rateLimitPointsDIDFlag, 200, "Maximum amount of rate limit points to spend per DID and sweep for listing and deleting posts (at least 2); the rest of the posts is deleted in the next sweeps (see https://atproto.com/blog/rate-limits-pds-v3; must be less than 1666 per hour as of September 2023)")
+	flags.Int(rateLimitPointsSweepFlag, 0, "Maximum amount of rate limit points to spend per sweep, which are shared evenly between DIDs with the ones with pending posts and the longest time since their last sweep first; DIDs which would get less than 2 points are deferred to the next sweep (if zero, only the limit per DID applies)")
+	flags.Int(rateLimitPointsGlobalFlag, 2500, "Maximum amount of rate limit points to spend per rate limit reset interval for this IP (see https://atproto.com/blog/rate-limits-pds-v3; must be less than 3000 per hour as of September 2023)")
+	flags.Duration(rateLimitResetIntervalFlag, time.Minute*5, "Duration of a rate limit reset interval for this IP (see https://atproto.com/blog/rate-limits-pds-v3; 5 minutes as of September 2023)")
+	flags.Int(listRecordsLimitFlag, 100, "Limit of records to return per API call (see https://atproto.com/blog/rate-limits-pds-v3; 100 as of September 2023)")
+	flags.Int(applyWritesLimitFlag, 10, "Limit of records to apply writes for per API call (see https://atproto.com/blog/rate-limits-pds-v3; 10 as of September 2023)")
+	flags.Bool(dryRunFlag, true, "Whether to do a dry run (only fetch for posts to be deleted without actually deleting them)")
+
+	flags.Int(jobsRetainFlag, 100, "Number of finished sweep jobs to keep in memory")
 }
 
 func init() {
 	workerCmd.PersistentFlags().String(laddrFlag, ":1338", "Listen address")
+	workerCmd.PersistentFlags().Duration(shutdownTimeoutFlag, time.Minute, "Time to wait for in-flight requests and sweeps to finish when shutting down")
+	workerCmd.PersistentFlags().Bool(autoMigrateFlag, false, "Whether to apply pending migrations on startup (if false, the worker only verifies the schema version and refuses to start if it is outdated; see the migrate command)")
 	workerCmd.PersistentFlags().String(apiKeyFlag, "", "API key to check incoming requests for")
+	workerCmd.PersistentFlags().String(adminTokenFlag, "", "Admin token to check incoming requests to the admin API for (must differ from the API key; if empty, the admin API is disabled)")
+
+	addSweepFlags(workerCmd.PersistentFlags())
+	addServicePolicyFlags(workerCmd.PersistentFlags())
+
+	workerCmd.PersistentFlags().String(plcDirectoryURLFlag, "https://plc.directory", "PLC directory URL to resolve did:plc DID documents with (used to follow PDS migrations)")
 
-	workerCmd.PersistentFlags().Int(rateLimitPointsDIDFlag, 200, "Maximum amount of rate limit points to spend per DID (see https://atproto.com/blog/rate-limits-pds-v3; must be less than 1666 per hour as of September 2023)")
-	workerCmd.PersistentFlags().Int(rateLimitPointsGlobalFlag, 2500, "Maximum amount of rate limit points to spend per rate limit reset interval for this IP (see https://atproto.com/blog/rate-limits-pds-v3; must be less than 3000 per hour as of September 2023)")
-	workerCmd.PersistentFlags().Duration(rateLimitResetIntervalFlag, time.Minute*5, "Duration of a rate limit reset interval for this IP (see https://atproto.com/blog/rate-limits-pds-v3; 5 minutes as of September 2023)")
-	workerCmd.PersistentFlags().Int(listRecordsLimitFlag, 100, "Limit of records to return per API call (see https://atproto.com/blog/rate-limits-pds-v3; 100 as of September 2023)")
-	workerCmd.PersistentFlags().Int(applyWritesLimitFlag, 10, "Limit of records to apply writes for per API call (see https://atproto.com/blog/rate-limits-pds-v3; 10 as of September 2023)")
-	workerCmd.PersistentFlags().Bool(dryRunFlag, true, "Whether to do a dry run (only fetch for posts to be deleted without actually deleting them)")
+	workerCmd.PersistentFlags().String(otlpEndpointFlag, "", "OTLP/HTTP collector endpoint to export traces to (e.g. http://localhost:4318; if empty, tracing is disabled)")
 
-	workerCmd.PersistentFlags().Bool(verboseFlag, false, "Whether to enable verbose logging")
+	workerCmd.PersistentFlags().Bool(verboseFlag, false, "Whether to enable verbose logging (shorthand for --log-level DEBUG)")
 
 	viper.AutomaticEnv()
 
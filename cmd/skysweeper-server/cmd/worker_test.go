@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/bluesky/bskytest"
+	"github.com/pojntfx/skysweeper/pkg/jobs"
+	"github.com/pojntfx/skysweeper/pkg/models"
+	"github.com/pojntfx/skysweeper/pkg/sweeper"
+	"github.com/spf13/viper"
+)
+
+const (
+	testHandle   = "alice.test"
+	testPassword = "alicepassword"
+
+	// Ages of posts relative to a post TTL of one month
+	expired   = time.Hour * 24 * 365
+	unexpired = time.Hour
+)
+
+func setupWorker(t *testing.T, pds *bskytest.Server) {
+	t.Helper()
+
+	viper.Set(rateLimitPointsDIDFlag, 200)
+	viper.Set(rateLimitPointsGlobalFlag, 2500)
+	viper.Set(rateLimitResetIntervalFlag, time.Minute*5)
+	viper.Set(listRecordsLimitFlag, 3)
+	viper.Set(applyWritesLimitFlag, 2)
+	viper.Set(dryRunFlag, false)
+	viper.Set(plcDirectoryURLFlag, pds.PLCDirectoryURL())
+	viper.Set(allowPrivateServicesFlag, true) // The PDS listens on loopback
+
+	t.Cleanup(viper.Reset)
+}
+
+// setupAccount creates an account with posts of the given ages and an enabled configuration
+// with a post TTL of one month for it
+func setupAccount(t *testing.T, pds *bskytest.Server, ages ...time.Duration) (string, *memoryPersister) {
+	t.Helper()
+
+	did := pds.AddAccount(testHandle, testPassword)
+	for _, age := range ages {
+		pds.AddPost(did, time.Now().Add(-age))
+	}
+
+	_, refreshJwt := pds.CreateSession(did)
+
+	return did, newMemoryPersister(models.Configuration{
+		Did:        did,
+		Service:    pds.URL,
+		RefreshJwt: refreshJwt,
+		Enabled:    true,
+		PostTtl:    1,
+	})
+}
+
+func runSweep(t *testing.T, persister sweeper.Persister, httpClient *http.Client) jobs.Snapshot {
+	t.Helper()
+
+	job, _, _ := jobs.NewRunner(1).Start(context.Background(), newSweep(persister, httpClient, ""))
+
+	select {
+	case <-job.Done():
+	case <-time.After(time.Second * 10):
+		t.Fatal("sweep did not finish")
+	}
+
+	return job.Snapshot()
+}
+
+func assertRefreshable(t *testing.T, pds *bskytest.Server, refreshJwt string) {
+	t.Helper()
+
+	if _, err := atproto.ServerRefreshSession(context.Background(), &xrpc.Client{
+		Client: pds.Client(),
+		Host:   pds.URL,
+		Auth: &xrpc.AuthInfo{
+			AccessJwt: refreshJwt,
+		},
+	}); err != nil {
+		t.Fatalf("stored refresh token is not valid: %v", err)
+	}
+}
+
+func TestWorkerSweepDeletesExpiredPosts(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	setupWorker(t, pds)
+
+	did, persister := setupAccount(t, pds, expired, expired, expired, expired, expired, unexpired, unexpired)
+	before, _ := persister.get(did)
+
+	snapshot := runSweep(t, persister, pds.Client())
+	if snapshot.Status != jobs.StatusSucceeded {
+		t.Fatalf("got status %v, want %v: %v", snapshot.Status, jobs.StatusSucceeded, snapshot.Error)
+	}
+
+	if snapshot.Progress.PostsDeleted != 5 || snapshot.Progress.DIDsDone != 1 {
+		t.Fatalf("got progress %+v, want 5 posts deleted for 1 DID", snapshot.Progress)
+	}
+
+	posts := pds.Posts(did)
+	if len(posts) != 2 {
+		t.Fatalf("got %v remaining posts, want %v", len(posts), 2)
+	}
+
+	after, _ := persister.get(did)
+	if after.RefreshJwt == before.RefreshJwt {
+		t.Fatal("refresh token has not been rotated")
+	}
+	assertRefreshable(t, pds, after.RefreshJwt)
+
+	// Posts are deleted, so the cursor is the key of the last deleted post, which precedes the first remaining one
+	if after.Cursor >= posts[0].Rkey {
+		t.Fatalf("got cursor %v, want it to precede the first remaining post %v", after.Cursor, posts[0].Rkey)
+	}
+}
+
+func TestWorkerSweepDoesNotDeleteInDryRunMode(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	setupWorker(t, pds)
+	viper.Set(dryRunFlag, true)
+
+	did, persister := setupAccount(t, pds, expired, expired, unexpired)
+
+	snapshot := runSweep(t, persister, pds.Client())
+	if snapshot.Status != jobs.StatusSucceeded {
+		t.Fatalf("got status %v, want %v: %v", snapshot.Status, jobs.StatusSucceeded, snapshot.Error)
+	}
+
+	if len(pds.Posts(did)) != 3 {
+		t.Fatalf("got %v remaining posts, want %v", len(pds.Posts(did)), 3)
+	}
+
+	if calls := pds.Calls(bskytest.MethodApplyWrites); calls != 0 {
+		t.Fatalf("got %v applyWrites calls, want none", calls)
+	}
+}
+
+func TestWorkerSweepResumesAfterFailedBatch(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	setupWorker(t, pds)
+
+	did, persister := setupAccount(t, pds, expired, expired, expired, expired, expired, unexpired)
+
+	pds.InjectFault(bskytest.Fault{
+		Method: bskytest.MethodApplyWrites,
+		Skip:   1,
+		Times:  1,
+		Status: http.StatusInternalServerError,
+		Error:  "InternalServerError",
+	})
+
+	runSweep(t, persister, pds.Client())
+
+	posts := pds.Posts(did)
+	if len(posts) != 4 {
+		t.Fatalf("got %v remaining posts after failed batch, want %v", len(posts), 4)
+	}
+
+	// The refresh token has been rotated before the failure, so it must have been saved
+	afterFailure, _ := persister.get(did)
+	assertRefreshable(t, pds, afterFailure.RefreshJwt)
+
+	// Refreshing in the assertion rotates the token again, so log in again for the next run
+	_, refreshJwt := pds.CreateSession(did)
+	if err := persister.UpdateRefreshTokenAndCursor(context.Background(), did, afterFailure.Cursor, refreshJwt); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := runSweep(t, persister, pds.Client())
+	if snapshot.Status != jobs.StatusSucceeded {
+		t.Fatalf("got status %v, want %v: %v", snapshot.Status, jobs.StatusSucceeded, snapshot.Error)
+	}
+
+	if posts := pds.Posts(did); len(posts) != 1 {
+		t.Fatalf("got %v remaining posts, want %v", len(posts), 1)
+	}
+}
+
+func TestWorkerSweepDisablesConfigurationWithRevokedSession(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	setupWorker(t, pds)
+
+	did, persister := setupAccount(t, pds, expired)
+
+	pds.RevokeSessions(did)
+
+	runSweep(t, persister, pds.Client())
+
+	c, _ := persister.get(did)
+	if c.Enabled || !c.DisabledByFailure {
+		t.Fatalf("got enabled %v and disabled by failure %v, want configuration to be disabled by failure", c.Enabled, c.DisabledByFailure)
+	}
+
+	if len(pds.Posts(did)) != 1 {
+		t.Fatal("posts have been deleted without a valid session")
+	}
+}
+
+func TestWorkerSweepSavesRefreshTokenWhenRateLimited(t *testing.T) {
+	pds := bskytest.NewServer()
+	defer pds.Close()
+
+	setupWorker(t, pds)
+
+	did, persister := setupAccount(t, pds, expired, expired)
+
+	// Only allow refreshing the session, but not listing records
+	pds.SetRateLimit(1, time.Hour)
+
+	runSweep(t, persister, pds.Client())
+
+	if calls := pds.Calls(bskytest.MethodListRecords); calls != 1 {
+		t.Fatalf("got %v listRecords calls, want %v", calls, 1)
+	}
+
+	if len(pds.Posts(did)) != 2 {
+		t.Fatal("posts have been deleted despite the rate limit")
+	}
+
+	pds.SetRateLimit(bskytest.DefaultRateLimit, bskytest.DefaultRateLimitWindow)
+
+	c, _ := persister.get(did)
+	assertRefreshable(t, pds, c.RefreshJwt)
+}
+
+func TestWorkerOnlyReturnsRunningSweepIfItCoversRequestedDID(t *testing.T) {
+	viper.Set(apiKeyFlag, "workersecret")
+	t.Cleanup(viper.Reset)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	runner := jobs.NewRunner(10)
+
+	mux := http.NewServeMux()
+	registerWorkerHandlers(context.Background(), mux, runner, func(did string) func(ctx context.Context, job *jobs.Job) error {
+		return func(ctx context.Context, job *jobs.Job) error {
+			<-release
+
+			return nil
+		}
+	})
+
+	worker := httptest.NewServer(mux)
+	defer worker.Close()
+
+	sweepPosts := func(did string) (int, jobs.Snapshot) {
+		req, err := http.NewRequest(http.MethodDelete, worker.URL+"/posts?did="+url.QueryEscape(did), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer workersecret")
+
+		res, err := worker.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var snapshot jobs.Snapshot
+		if res.StatusCode == http.StatusAccepted {
+			if err := json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return res.StatusCode, snapshot
+	}
+
+	status, alice := sweepPosts("did:plc:alice")
+	if status != http.StatusAccepted {
+		t.Fatalf("got status %v for first sweep, want %v", status, http.StatusAccepted)
+	}
+
+	if status, snapshot := sweepPosts("did:plc:alice"); status != http.StatusAccepted || snapshot.ID != alice.ID {
+		t.Fatalf("got status %v and job %v for sweep of same DID, want the running job %v", status, snapshot.ID, alice.ID)
+	}
+
+	// Neither a sweep of another DID nor one of all DIDs is covered by the running sweep
+	for _, did := range []string{"did:plc:bob", ""} {
+		if status, _ := sweepPosts(did); status != http.StatusServiceUnavailable {
+			t.Fatalf("got status %v for sweep of %q, want %v", status, did, http.StatusServiceUnavailable)
+		}
+	}
+}
@@ -1,4 +1,24 @@
 export interface IConfiguration {
   enabled: boolean;
   postTTL: number;
+  backlog?: IConfigurationBacklog;
+}
+
+export interface IConfigurationBacklog {
+  postsPending: number;
+  sweeps?: number;
+}
+
+export interface IProblem {
+  type: string;
+  title: string;
+  status: number;
+  detail?: string;
+  instance?: string;
+  errors?: IFieldError[];
+}
+
+export interface IFieldError {
+  pointer: string;
+  detail: string;
 }
@@ -1,4 +1,41 @@
-import { IConfiguration } from "./models";
+import { IConfiguration, IProblem } from "./models";
+
+export class ProblemError extends Error {
+  constructor(public problem: IProblem) {
+    super(
+      [
+        problem.detail || problem.title,
+        ...(problem.errors || []).map(
+          (e) => `${e.pointer.replace(/^#\//, "")} ${e.detail}`
+        ),
+      ].join("; ")
+    );
+
+    this.name = "ProblemError";
+  }
+}
+
+const checkResponse = async (response: Response) => {
+  if (response.ok) {
+    return response;
+  }
+
+  let problem: IProblem = {
+    type: "about:blank",
+    title: response.statusText,
+    status: response.status,
+  };
+
+  if (
+    response.headers
+      .get("Content-Type")
+      ?.startsWith("application/problem+json")
+  ) {
+    problem = await response.json();
+  }
+
+  throw new ProblemError(problem);
+};
 
 export class ConfigurationRestAPI {
   constructor(
@@ -28,7 +65,7 @@ export class ConfigurationRestAPI {
       });
     }
 
-    return response.json();
+    return (await checkResponse(response)).json();
   }
 
   async updateConfiguration(config: IConfiguration): Promise<IConfiguration> {
@@ -39,14 +76,39 @@ export class ConfigurationRestAPI {
     }).toString();
 
     return (
-      await fetch(configurationURL.toString(), {
-        method: "PUT",
-        body: JSON.stringify(config),
-        headers: {
-          Authorization: "Bearer " + this.refreshJWT,
-          "Content-Type": "application/json",
-        },
-      })
+      await checkResponse(
+        await fetch(configurationURL.toString(), {
+          method: "PUT",
+          body: JSON.stringify(config),
+          headers: {
+            Authorization: "Bearer " + this.refreshJWT,
+            "Content-Type": "application/json",
+          },
+        })
+      )
+    ).json();
+  }
+
+  async patchConfiguration(
+    config: Partial<IConfiguration>
+  ): Promise<IConfiguration> {
+    const configurationURL = new URL(this.apiURL + "configuration");
+
+    configurationURL.search = new URLSearchParams({
+      service: this.service,
+    }).toString();
+
+    return (
+      await checkResponse(
+        await fetch(configurationURL.toString(), {
+          method: "PATCH",
+          body: JSON.stringify(config),
+          headers: {
+            Authorization: "Bearer " + this.refreshJWT,
+            "Content-Type": "application/merge-patch+json",
+          },
+        })
+      )
     ).json();
   }
 
@@ -57,11 +119,13 @@ export class ConfigurationRestAPI {
       service: this.service,
     }).toString();
 
-    await fetch(configurationURL.toString(), {
-      method: "DELETE",
-      headers: {
-        Authorization: "Bearer " + this.accessJWT,
-      },
-    });
+    await checkResponse(
+      await fetch(configurationURL.toString(), {
+        method: "DELETE",
+        headers: {
+          Authorization: "Bearer " + this.accessJWT,
+        },
+      })
+    );
   }
 }
@@ -143,6 +143,7 @@ export default function Home() {
 
     enabled,
     postTTL,
+    backlog,
 
     saveConfiguration,
     deleteData,
@@ -400,6 +401,23 @@ export default function Home() {
                                 it will delete them for you automatically.
                               </FormDescription>
 
+                              {backlog && (
+                                <FormDescription>
+                                  Approximately {backlog.postsPending} old
+                                  skeet{backlog.postsPending === 1 ? "" : "s"}{" "}
+                                  still have to be deleted
+                                  {backlog.sweeps
+                                    ? `, which will take about ${
+                                        backlog.sweeps
+                                      } more run${
+                                        backlog.sweeps > 1 ? "s" : ""
+                                      }`
+                                    : ""}
+                                  . Large accounts are swept over multiple runs
+                                  to stay within Bluesky&apos;s rate limits.
+                                </FormDescription>
+                              )}
+
                               <FormControl>
                                 <div className="flex w-full items-center justify-center space-x-2 pt-2">
                                   <Input
@@ -0,0 +1,16 @@
+//go:build embed_frontend
+
+package frontend
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:out
+var out embed.FS
+
+// FS returns the static export of the PWA
+func FS() (fs.FS, error) {
+	return fs.Sub(out, "out")
+}
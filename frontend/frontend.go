@@ -0,0 +1,9 @@
+// Package frontend contains the static export of the PWA, which is embedded into the server
+// if it is built with the `embed_frontend` tag after running `bun run build`
+package frontend
+
+import "errors"
+
+var (
+	ErrNotEmbedded = errors.New("frontend is not embedded, rebuild with -tags embed_frontend")
+)
@@ -1,3 +1,4 @@
+import { IConfigurationBacklog } from "@/api/models";
 import { ConfigurationRestAPI } from "@/api/rest";
 import { BskyAgent } from "@atproto/api";
 import { useCallback, useState } from "react";
@@ -99,6 +100,7 @@ export const useAPI = (
 
   const [enabled, setEnabled] = useState(false);
   const [postTTL, setPostTTL] = useState(6);
+  const [backlog, setBacklog] = useState<IConfigurationBacklog>();
   useAsyncEffect(async () => {
     if (!api) {
       return;
@@ -111,6 +113,7 @@ export const useAPI = (
 
       setPostTTL(res.postTTL);
       setEnabled(res.enabled);
+      setBacklog(res.backlog);
     } catch (e) {
       handleError(e as Error, false);
     } finally {
@@ -125,6 +128,7 @@ export const useAPI = (
 
     enabled,
     postTTL,
+    backlog,
 
     saveConfiguration: async (enabled: boolean, postTTL: number) => {
       if (!api) {
@@ -134,7 +138,7 @@ export const useAPI = (
       setLoading(true);
 
       try {
-        const res = await api.updateConfiguration({
+        const res = await api.patchConfiguration({
           enabled,
           postTTL,
         });
@@ -0,0 +1,10 @@
+//go:build !embed_frontend
+
+package frontend
+
+import "io/fs"
+
+// FS returns the static export of the PWA
+func FS() (fs.FS, error) {
+	return nil, ErrNotEmbedded
+}
@@ -0,0 +1,607 @@
+// Package bskytest provides an in-memory PDS for tests, which implements the subset of the
+// XRPC API that SkySweeper uses as well as a PLC directory for the accounts it hosts.
+package bskytest
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+)
+
+const (
+	MethodCreateSession  = "com.atproto.server.createSession"
+	MethodRefreshSession = "com.atproto.server.refreshSession"
+	MethodGetSession     = "com.atproto.server.getSession"
+	MethodListRecords    = "com.atproto.repo.listRecords"
+	MethodApplyWrites    = "com.atproto.repo.applyWrites"
+
+	CollectionPost = "app.bsky.feed.post"
+
+	// Defaults as per https://atproto.com/blog/rate-limits-pds-v3
+	DefaultRateLimit       = 3000
+	DefaultRateLimitWindow = time.Minute * 5
+
+	scopeAccess  = "com.atproto.access"
+	scopeRefresh = "com.atproto.refresh"
+
+	defaultListRecordsLimit = 50
+	maxListRecordsLimit     = 100
+	maxApplyWrites          = 200
+
+	xrpcPrefix = "/xrpc/"
+	didPrefix  = "/did:"
+)
+
+type Post struct {
+	Rkey      string
+	CreatedAt time.Time
+}
+
+// Fault makes calls to an XRPC method fail
+type Fault struct {
+	Method string // NSID of the method to fail, e.g. `MethodApplyWrites`
+
+	Skip  int // Number of calls to let through before failing
+	Times int // Number of calls to fail; if 0, all following calls fail
+
+	Status  int    // HTTP status code to respond with
+	Error   string // XRPC error name, e.g. `InternalServerError`
+	Message string
+}
+
+type account struct {
+	did      string
+	handle   string
+	password string
+	posts    []Post
+}
+
+type session struct {
+	did   string
+	scope string
+}
+
+type fault struct {
+	Fault
+
+	calls int
+}
+
+// Server is an in-memory PDS served by a `httptest.Server`
+type Server struct {
+	*httptest.Server
+
+	lock sync.Mutex
+
+	accounts map[string]*account // By DID
+	handles  map[string]string   // Handle to DID
+	sessions map[string]session  // By JWT
+
+	tokens int
+	rkeys  int
+
+	rateLimit          int
+	rateLimitWindow    time.Duration
+	rateLimitRemaining int
+	rateLimitReset     time.Time
+
+	faults []*fault
+	calls  map[string]int
+}
+
+// NewServer starts an in-memory PDS with the default rate limit; it must be closed with `Close`
+func NewServer() *Server {
+	s := &Server{
+		accounts: map[string]*account{},
+		handles:  map[string]string{},
+		sessions: map[string]session{},
+
+		calls: map[string]int{},
+	}
+
+	s.SetRateLimit(DefaultRateLimit, DefaultRateLimitWindow)
+
+	s.Server = httptest.NewServer(s)
+
+	return s
+}
+
+// PLCDirectoryURL returns the URL of a PLC directory which resolves the DIDs of all accounts to this PDS
+func (s *Server) PLCDirectoryURL() string {
+	return s.URL
+}
+
+// AddAccount creates an account and returns its DID
+func (s *Server) AddAccount(handle, password string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hash := sha256.Sum256([]byte(handle))
+	did := "did:plc:" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:15]))
+
+	s.accounts[did] = &account{
+		did:      did,
+		handle:   handle,
+		password: password,
+		posts:    []Post{},
+	}
+	s.handles[handle] = did
+
+	return did
+}
+
+// AddPost creates a post and returns its record key; like TIDs, record keys increase
+// with every post, so posts should be added from oldest to newest
+func (s *Server) AddPost(did string, createdAt time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.rkeys++
+	rkey := fmt.Sprintf("3k%011d", s.rkeys)
+
+	if a, ok := s.accounts[did]; ok {
+		a.posts = append(a.posts, Post{
+			Rkey:      rkey,
+			CreatedAt: createdAt,
+		})
+	}
+
+	return rkey
+}
+
+// SetPostCreatedAt changes when a post has been created without changing its record key
+func (s *Server) SetPostCreatedAt(did, rkey string, createdAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, ok := s.accounts[did]
+	if !ok {
+		return
+	}
+
+	for i := range a.posts {
+		if a.posts[i].Rkey == rkey {
+			a.posts[i].CreatedAt = createdAt
+		}
+	}
+}
+
+// Posts returns the posts of an account from oldest to newest
+func (s *Server) Posts(did string) []Post {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, ok := s.accounts[did]
+	if !ok {
+		return []Post{}
+	}
+
+	return append([]Post{}, a.posts...)
+}
+
+// CreateSession logs into an account like `createSession` does and returns its access and refresh JWTs
+func (s *Server) CreateSession(did string) (string, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.createSession(did)
+}
+
+// RevokeSessions invalidates all access and refresh JWTs of an account
+func (s *Server) RevokeSessions(did string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for jwt, session := range s.sessions {
+		if session.did == did {
+			delete(s.sessions, jwt)
+		}
+	}
+}
+
+// SetRateLimit sets the number of requests allowed per window and resets the current window
+func (s *Server) SetRateLimit(limit int, window time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.rateLimit = limit
+	s.rateLimitWindow = window
+	s.rateLimitRemaining = limit
+	s.rateLimitReset = time.Now().Add(window)
+}
+
+// InjectFault makes calls to a method fail; faults are checked in the order they have been injected
+func (s *Server) InjectFault(f Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.faults = append(s.faults, &fault{Fault: f})
+}
+
+// ClearFaults removes all injected faults
+func (s *Server) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.faults = nil
+}
+
+// Calls returns the number of calls to a method, including failed ones
+func (s *Server) Calls(method string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.calls[method]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if strings.HasPrefix(r.URL.Path, didPrefix) {
+		s.resolveDID(w, r)
+
+		return
+	}
+
+	method, ok := strings.CutPrefix(r.URL.Path, xrpcPrefix)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound", "Not found")
+
+		return
+	}
+
+	s.calls[method]++
+
+	if !s.spendRateLimit(w) {
+		writeError(w, http.StatusTooManyRequests, "RateLimitExceeded", "Rate Limit Exceeded")
+
+		return
+	}
+
+	for _, f := range s.faults {
+		if f.Method != method {
+			continue
+		}
+
+		f.calls++
+		if f.calls <= f.Skip || (f.Times > 0 && f.calls > f.Skip+f.Times) {
+			continue
+		}
+
+		writeError(w, f.Status, f.Error, f.Message)
+
+		return
+	}
+
+	switch method {
+	case MethodCreateSession:
+		s.handleCreateSession(w, r)
+
+	case MethodRefreshSession:
+		s.handleRefreshSession(w, r)
+
+	case MethodGetSession:
+		s.handleGetSession(w, r)
+
+	case MethodListRecords:
+		s.handleListRecords(w, r)
+
+	case MethodApplyWrites:
+		s.handleApplyWrites(w, r)
+
+	default:
+		writeError(w, http.StatusNotImplemented, "MethodNotImplemented", "Method Not Implemented")
+	}
+}
+
+func (s *Server) spendRateLimit(w http.ResponseWriter) bool {
+	if now := time.Now(); now.After(s.rateLimitReset) {
+		s.rateLimitRemaining = s.rateLimit
+		s.rateLimitReset = now.Add(s.rateLimitWindow)
+	}
+
+	allowed := s.rateLimitRemaining > 0
+	if allowed {
+		s.rateLimitRemaining--
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(s.rateLimit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(s.rateLimitRemaining))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(s.rateLimitReset.Unix(), 10))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", s.rateLimit, int(s.rateLimitWindow.Seconds())))
+
+	return allowed
+}
+
+func (s *Server) resolveDID(w http.ResponseWriter, r *http.Request) {
+	did := strings.TrimPrefix(r.URL.Path, "/")
+
+	if _, ok := s.accounts[did]; !ok {
+		writeError(w, http.StatusNotFound, "NotFound", "DID not registered: "+did)
+
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"@context": []string{"https://www.w3.org/ns/did/v1"},
+		"id":       did,
+		"service": []map[string]string{
+			{
+				"id":              "#atproto_pds",
+				"type":            "AtprotoPersonalDataServer",
+				"serviceEndpoint": s.URL,
+			},
+		},
+	})
+}
+
+func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	var input atproto.ServerCreateSession_Input
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+
+		return
+	}
+
+	a := s.getAccount(input.Identifier)
+	if a == nil || a.password != input.Password {
+		writeError(w, http.StatusUnauthorized, "AuthenticationRequired", "Invalid identifier or password")
+
+		return
+	}
+
+	accessJwt, refreshJwt := s.createSession(a.did)
+
+	writeJSON(w, atproto.ServerCreateSession_Output{
+		AccessJwt:  accessJwt,
+		RefreshJwt: refreshJwt,
+		Did:        a.did,
+		Handle:     a.handle,
+	})
+}
+
+func (s *Server) handleRefreshSession(w http.ResponseWriter, r *http.Request) {
+	jwt, sess, ok := s.authenticate(w, r, scopeRefresh)
+	if !ok {
+		return
+	}
+
+	// Refresh tokens can only be used once
+	delete(s.sessions, jwt)
+
+	accessJwt, refreshJwt := s.createSession(sess.did)
+
+	writeJSON(w, atproto.ServerRefreshSession_Output{
+		AccessJwt:  accessJwt,
+		RefreshJwt: refreshJwt,
+		Did:        sess.did,
+		Handle:     s.accounts[sess.did].handle,
+	})
+}
+
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	_, sess, ok := s.authenticate(w, r, scopeAccess)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, atproto.ServerGetSession_Output{
+		Did:    sess.did,
+		Handle: s.accounts[sess.did].handle,
+	})
+}
+
+func (s *Server) handleListRecords(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	a := s.getAccount(q.Get("repo"))
+	if a == nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Could not find repo: "+q.Get("repo"))
+
+		return
+	}
+
+	limit := defaultListRecordsLimit
+	if rawLimit := q.Get("limit"); rawLimit != "" {
+		l, err := strconv.Atoi(rawLimit)
+		if err != nil || l < 1 || l > maxListRecordsLimit {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", "Invalid limit: "+rawLimit)
+
+			return
+		}
+
+		limit = l
+	}
+
+	cursor := q.Get("cursor")
+	reverse := q.Get("reverse") == "true"
+
+	posts := []Post{}
+	if q.Get("collection") == CollectionPost {
+		posts = append(posts, a.posts...)
+	}
+
+	// Without `reverse`, records are listed from newest to oldest
+	sort.Slice(posts, func(i, j int) bool {
+		if reverse {
+			return posts[i].Rkey < posts[j].Rkey
+		}
+
+		return posts[i].Rkey > posts[j].Rkey
+	})
+
+	type record struct {
+		URI   string         `json:"uri"`
+		CID   string         `json:"cid"`
+		Value map[string]any `json:"value"`
+	}
+
+	res := struct {
+		Cursor  string   `json:"cursor,omitempty"`
+		Records []record `json:"records"`
+	}{
+		Records: []record{},
+	}
+	for _, post := range posts {
+		if len(res.Records) >= limit {
+			break
+		}
+
+		if cursor != "" && ((reverse && post.Rkey <= cursor) || (!reverse && post.Rkey >= cursor)) {
+			continue
+		}
+
+		res.Records = append(res.Records, record{
+			URI: "at://" + a.did + "/" + CollectionPost + "/" + post.Rkey,
+			CID: "bafyrei" + strings.ToLower(post.Rkey),
+			Value: map[string]any{
+				"$type":     CollectionPost,
+				"text":      "Post " + post.Rkey,
+				"createdAt": post.CreatedAt.UTC().Format(time.RFC3339Nano),
+			},
+		})
+		res.Cursor = post.Rkey
+	}
+
+	writeJSON(w, res)
+}
+
+func (s *Server) handleApplyWrites(w http.ResponseWriter, r *http.Request) {
+	_, sess, ok := s.authenticate(w, r, scopeAccess)
+	if !ok {
+		return
+	}
+
+	var input atproto.RepoApplyWrites_Input
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+
+		return
+	}
+
+	a := s.getAccount(input.Repo)
+	if a == nil || a.did != sess.did {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Can not write to repo: "+input.Repo)
+
+		return
+	}
+
+	if len(input.Writes) > maxApplyWrites {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Too many writes")
+
+		return
+	}
+
+	deletes := map[string]struct{}{}
+	for _, write := range input.Writes {
+		if write.RepoApplyWrites_Delete == nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", "Only deletes are supported")
+
+			return
+		}
+
+		if write.RepoApplyWrites_Delete.Collection == CollectionPost {
+			deletes[write.RepoApplyWrites_Delete.Rkey] = struct{}{}
+		}
+	}
+
+	posts := []Post{}
+	for _, post := range a.posts {
+		if _, ok := deletes[post.Rkey]; !ok {
+			posts = append(posts, post)
+		}
+	}
+	a.posts = posts
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getAccount(identifier string) *account {
+	if did, ok := s.handles[identifier]; ok {
+		identifier = did
+	}
+
+	return s.accounts[identifier]
+}
+
+func (s *Server) createSession(did string) (string, string) {
+	accessJwt := s.newJWT(did, scopeAccess, time.Hour*2)
+	refreshJwt := s.newJWT(did, scopeRefresh, time.Hour*24*90)
+
+	s.sessions[accessJwt] = session{did, scopeAccess}
+	s.sessions[refreshJwt] = session{did, scopeRefresh}
+
+	return accessJwt, refreshJwt
+}
+
+// newJWT returns an unsigned JWT with the same claims as the ones a PDS issues
+func (s *Server) newJWT(did, scope string, ttl time.Duration) string {
+	s.tokens++
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "HS256",
+		"typ": "JWT",
+	})
+	claims, _ := json.Marshal(map[string]any{
+		"scope": scope,
+		"sub":   did,
+		"iat":   now.Unix(),
+		"exp":   now.Add(ttl).Unix(),
+		"jti":   strconv.Itoa(s.tokens),
+	})
+
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims) + ".bskytest"
+}
+
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, scope string) (string, session, bool) {
+	jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.TrimSpace(jwt) == "" {
+		writeError(w, http.StatusUnauthorized, "AuthMissing", "Authentication Required")
+
+		return "", session{}, false
+	}
+
+	sess, ok := s.sessions[jwt]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "ExpiredToken", "Token has expired")
+
+		return "", session{}, false
+	}
+
+	if sess.scope != scope {
+		writeError(w, http.StatusBadRequest, "InvalidToken", "Invalid token type")
+
+		return "", session{}, false
+	}
+
+	return jwt, sess, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, name, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":   name,
+		"message": message,
+	})
+}
@@ -3,6 +3,7 @@ package bluesky
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -12,12 +13,20 @@ import (
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/logging"
+	"github.com/pojntfx/skysweeper/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	collectionTypePost = "app.bsky.feed.post"
 )
 
+var (
+	ErrUnexpectedStatus = errors.New("unexpected status code")
+)
+
 type repo struct {
 	Records []record `json:"records"`
 	Cursor  string   `json:"cursor"`
@@ -37,6 +46,8 @@ type Record struct {
 }
 
 func GetPostsToDelete(
+	ctx context.Context,
+
 	client *xrpc.Client,
 
 	postTTL int,
@@ -44,87 +55,249 @@ func GetPostsToDelete(
 	batchSize int,
 	limit int,
 
-	limiter *Limiter,
+	limiter Spender,
 ) ([]Record, string, error) {
-	rawURL, err := url.JoinPath(client.Host, "/xrpc/com.atproto.repo.listRecords")
-	if err != nil {
-		return []Record{}, "", err
-	}
-
-	u, err := url.Parse(rawURL)
+	u, err := getListRecordsURL(client)
 	if err != nil {
 		return []Record{}, "", err
 	}
 
 	recordsToDelete := []Record{}
-l:
 	for i := 0; i < limit; i++ {
-		if err := limiter.Spend(PointsGet); err != nil {
+		if err := ctx.Err(); err != nil {
 			return []Record{}, "", err
 		}
 
-		q := u.Query()
-		q.Set("repo", client.Auth.Did)
-		q.Set("collection", collectionTypePost)
-		q.Set("reverse", "true")
-		q.Set("limit", fmt.Sprintf("%d", batchSize))
-		q.Set("cursor", cursor)
-		u.RawQuery = q.Encode()
-
-		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		repo, err := listPostsPage(ctx, client, u, cursor, batchSize, i, limiter)
 		if err != nil {
 			return []Record{}, "", err
 		}
-		req.Header.Set("Authorization", client.Auth.AccessJwt)
 
-		resp, err := http.DefaultClient.Do(req)
+		expired, reachedUnexpired, err := getExpiredRecords(repo.Records, postTTL)
 		if err != nil {
 			return []Record{}, "", err
 		}
-		defer resp.Body.Close()
 
-		var repo repo
-		if err = json.NewDecoder(resp.Body).Decode(&repo); err != nil {
-			return []Record{}, "", err
+		recordsToDelete = append(recordsToDelete, expired...)
+
+		var done bool
+		cursor, done = getNextCursor(cursor, repo, expired, reachedUnexpired)
+		if done {
+			break
 		}
+	}
 
-		cursor = repo.Cursor
+	return recordsToDelete, cursor, nil
+}
 
-		maximumAge := time.Now().AddDate(0, -postTTL, 0)
-		for _, record := range repo.Records {
-			recordDate, err := time.Parse(time.RFC3339Nano, record.Value.CreatedAt)
-			if err != nil {
-				recordDate, err = time.Parse("2006-01-02T15:04:05.999999", record.Value.CreatedAt) // For some reason, Bsky sometimes seems to not specify the timezone
-				if err != nil {
-					return []Record{}, "", err
-				}
-			}
+// SweepPosts lists posts page by page and deletes the expired posts of each page before listing the next one.
+// After each page, commit is called with the cursor to resume from, so that a failure only loses the current page;
+// if deleting a page fails after some of its posts have been deleted, commit is called with the key of the last deleted post.
+// If onPageListed or onBatchDeleted are not nil, they are called with the expired posts of each page and with each deleted batch.
+// It returns the number of deleted posts.
+func SweepPosts(
+	ctx context.Context,
+
+	client *xrpc.Client,
+
+	postTTL int,
+	cursor string,
+	listBatchSize int,
+	limit int,
+	deleteBatchSize int,
+
+	dryRun bool,
+
+	limiter Spender,
+
+	onPageListed func(posts []Record),
+	onBatchDeleted func(batch []Record),
+	commit func(cursor string) error,
+) (int, error) {
+	u, err := getListRecordsURL(client)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for i := 0; i < limit; i++ {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		repo, err := listPostsPage(ctx, client, u, cursor, listBatchSize, i, limiter)
+		if err != nil {
+			return deleted, err
+		}
+
+		expired, reachedUnexpired, err := getExpiredRecords(repo.Records, postTTL)
+		if err != nil {
+			return deleted, err
+		}
+
+		if onPageListed != nil {
+			onPageListed(expired)
+		}
 
-			if recordDate.Before(maximumAge) {
-				uri, err := util.ParseAtUri(record.URI)
-				if err != nil {
-					return []Record{}, "", err
-				}
-
-				recordsToDelete = append(recordsToDelete, Record{
-					DID:       uri.Did,
-					Rkey:      uri.Rkey,
-					CreatedAt: recordDate,
-				})
-			} else {
-				break l
+		pageDeleted, err := DeletePosts(ctx, client, expired, deleteBatchSize, dryRun, limiter, onBatchDeleted)
+		deleted += pageDeleted
+		if err != nil {
+			// Records are listed from oldest to newest, so we can resume after the last deleted post
+			if pageDeleted > 0 {
+				return deleted, errors.Join(err, commit(expired[pageDeleted-1].Rkey))
 			}
+
+			return deleted, err
+		}
+
+		var done bool
+		cursor, done = getNextCursor(cursor, repo, expired, reachedUnexpired)
+
+		if err := commit(cursor); err != nil {
+			return deleted, err
 		}
 
-		// Terminate if there are no more posts
-		if i > 0 && strings.TrimSpace(cursor) == "" {
+		if done {
 			break
 		}
 	}
 
-	return recordsToDelete, cursor, nil
+	return deleted, nil
 }
 
+// getNextCursor returns the cursor to continue listing from after a page and whether listing is done.
+// Since records are listed from oldest to newest and the cursor is exclusive, the cursor must always
+// be the key of the last expired record, which makes the next listing start at the first unexpired one;
+// using the cursor of the page instead would skip the rest of the page once an unexpired record has been found.
+func getNextCursor(cursor string, r repo, expired []Record, reachedUnexpired bool) (string, bool) {
+	if len(expired) > 0 {
+		cursor = expired[len(expired)-1].Rkey
+	}
+
+	// Terminate if there are no more expired posts or no more posts at all
+	if reachedUnexpired || len(r.Records) == 0 || strings.TrimSpace(r.Cursor) == "" {
+		return cursor, true
+	}
+
+	return cursor, false
+}
+
+func getListRecordsURL(client *xrpc.Client) (*url.URL, error) {
+	rawURL, err := url.JoinPath(client.Host, "/xrpc/com.atproto.repo.listRecords")
+	if err != nil {
+		return nil, err
+	}
+
+	return url.Parse(rawURL)
+}
+
+// getExpiredRecords returns the records which are older than postTTL (in months) up to the first record
+// which isn't, and whether such a record has been found
+func getExpiredRecords(records []record, postTTL int) ([]Record, bool, error) {
+	expired := []Record{}
+
+	maximumAge := time.Now().AddDate(0, -postTTL, 0)
+	for _, record := range records {
+		recordDate, err := time.Parse(time.RFC3339Nano, record.Value.CreatedAt)
+		if err != nil {
+			recordDate, err = time.Parse("2006-01-02T15:04:05.999999", record.Value.CreatedAt) // For some reason, Bsky sometimes seems to not specify the timezone
+			if err != nil {
+				return []Record{}, false, err
+			}
+		}
+
+		if !recordDate.Before(maximumAge) {
+			return expired, true, nil
+		}
+
+		uri, err := util.ParseAtUri(record.URI)
+		if err != nil {
+			return []Record{}, false, err
+		}
+
+		expired = append(expired, Record{
+			DID:       uri.Did,
+			Rkey:      uri.Rkey,
+			CreatedAt: recordDate,
+		})
+	}
+
+	return expired, false, nil
+}
+
+func listPostsPage(
+	ctx context.Context,
+
+	client *xrpc.Client,
+	u *url.URL,
+
+	cursor string,
+	batchSize int,
+	page int,
+
+	limiter Spender,
+) (r repo, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "GetPostsToDelete.page", trace.WithAttributes(
+		attribute.Int("page", page),
+		attribute.String("cursor", cursor),
+	))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
+	if err := limiter.Spend(ctx, PointsGet); err != nil {
+		return repo{}, err
+	}
+
+	q := u.Query()
+	q.Set("repo", client.Auth.Did)
+	q.Set("collection", collectionTypePost)
+	q.Set("reverse", "true")
+	q.Set("limit", fmt.Sprintf("%d", batchSize))
+	q.Set("cursor", cursor)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return repo{}, err
+	}
+	req.Header.Set("Authorization", client.Auth.AccessJwt)
+
+	httpClient := client.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return repo{}, err
+	}
+	defer resp.Body.Close()
+
+	// Errors such as exceeded rate limits would otherwise be decoded as an empty page
+	if resp.StatusCode != http.StatusOK {
+		var xe xrpc.XRPCError
+		if err := json.NewDecoder(resp.Body).Decode(&xe); err != nil {
+			return repo{}, fmt.Errorf("%w: %v", ErrUnexpectedStatus, resp.StatusCode)
+		}
+
+		return repo{}, fmt.Errorf("%w: %v: %w", ErrUnexpectedStatus, resp.StatusCode, &xe)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return repo{}, err
+	}
+
+	span.SetAttributes(attribute.Int("records", len(r.Records)))
+
+	logging.FromContext(ctx).Debug("Listed posts", "page", page, "records", len(r.Records))
+
+	return r, nil
+}
+
+// DeletePosts deletes posts in batches and returns how many of them have been deleted.
+// If ctx is cancelled, it stops between batches while letting the in-flight batch finish.
+// If onBatchDeleted is not nil, it is called after each batch has been deleted.
 func DeletePosts(
 	ctx context.Context,
 
@@ -135,18 +308,28 @@ func DeletePosts(
 
 	dryRun bool,
 
-	limiter *Limiter,
-) error {
+	limiter Spender,
+
+	onBatchDeleted func(batch []Record),
+) (int, error) {
 	if len(posts) <= 0 {
-		return nil
+		return 0, nil
 	}
 
+	dids := []string{}
 	postsByDID := make(map[string][]Record)
 	for _, post := range posts {
+		if _, ok := postsByDID[post.DID]; !ok {
+			dids = append(dids, post.DID)
+		}
+
 		postsByDID[post.DID] = append(postsByDID[post.DID], post)
 	}
 
-	for did, posts := range postsByDID {
+	deleted := 0
+	for _, did := range dids {
+		posts := postsByDID[did]
+
 		var batches [][]Record
 		for i := 0; i < len(posts); i += batchSize {
 			end := i + batchSize
@@ -157,31 +340,79 @@ func DeletePosts(
 			batches = append(batches, posts[i:end])
 		}
 
-		for _, batch := range batches {
-			var writeElems []*atproto.RepoApplyWrites_Input_Writes_Elem
-			for _, post := range batch {
-				writeElems = append(writeElems, &atproto.RepoApplyWrites_Input_Writes_Elem{
-					RepoApplyWrites_Delete: &atproto.RepoApplyWrites_Delete{
-						Collection: collectionTypePost,
-						Rkey:       post.Rkey,
-					},
-				})
+		for i, batch := range batches {
+			if err := ctx.Err(); err != nil {
+				return deleted, err
 			}
 
-			if !dryRun {
-				if err := limiter.Spend(PointsDelete); err != nil {
-					return err
-				}
-
-				if err := atproto.RepoApplyWrites(ctx, client, &atproto.RepoApplyWrites_Input{
-					Repo:   did,
-					Writes: writeElems,
-				}); err != nil {
-					return err
-				}
+			if err := deletePostsBatch(ctx, client, did, batch, i, dryRun, limiter); err != nil {
+				return deleted, err
+			}
+
+			deleted += len(batch)
+
+			if onBatchDeleted != nil {
+				onBatchDeleted(batch)
 			}
 		}
 	}
 
+	return deleted, nil
+}
+
+func deletePostsBatch(
+	ctx context.Context,
+
+	client *xrpc.Client,
+
+	did string,
+	batch []Record,
+	index int,
+
+	dryRun bool,
+
+	limiter Spender,
+) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "DeletePosts.batch", trace.WithAttributes(
+		attribute.Int("batch", index),
+		attribute.Int("records", len(batch)),
+		attribute.Bool("dryRun", dryRun),
+	))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
+	var writeElems []*atproto.RepoApplyWrites_Input_Writes_Elem
+	for _, post := range batch {
+		writeElems = append(writeElems, &atproto.RepoApplyWrites_Input_Writes_Elem{
+			RepoApplyWrites_Delete: &atproto.RepoApplyWrites_Delete{
+				Collection: collectionTypePost,
+				Rkey:       post.Rkey,
+			},
+		})
+	}
+
+	logger := logging.FromContext(ctx).With("batch", index)
+
+	if dryRun {
+		logger.Debug("Skipping deletion of posts in dry run mode", "posts", len(batch))
+
+		return nil
+	}
+
+	if err := limiter.Spend(ctx, PointsDelete); err != nil {
+		return err
+	}
+
+	// Don't abort in-flight writes if ctx is cancelled so that we know whether they have been applied
+	if err := atproto.RepoApplyWrites(context.WithoutCancel(ctx), client, &atproto.RepoApplyWrites_Input{
+		Repo:   did,
+		Writes: writeElems,
+	}); err != nil {
+		return err
+	}
+
+	logger.Debug("Deleted posts", "posts", len(batch))
+
 	return nil
 }
@@ -0,0 +1,252 @@
+package bluesky
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/bluesky/bskytest"
+)
+
+const (
+	// Ages of posts relative to a post TTL of one month
+	expired   = time.Hour * 24 * 365
+	unexpired = time.Hour
+)
+
+// newTestServer starts an in-memory PDS with an account which has one post per age, from oldest to newest,
+// and returns the record keys of its posts and a client logged into it
+func newTestServer(t *testing.T, ages ...time.Duration) (*bskytest.Server, string, []string, *xrpc.Client) {
+	t.Helper()
+
+	srv := bskytest.NewServer()
+	t.Cleanup(srv.Close)
+
+	did := srv.AddAccount("test.bsky.social", "password")
+
+	rkeys := []string{}
+	for _, age := range ages {
+		rkeys = append(rkeys, srv.AddPost(did, time.Now().Add(-age)))
+	}
+
+	accessJwt, refreshJwt := srv.CreateSession(did)
+
+	return srv, did, rkeys, &xrpc.Client{
+		Client: srv.Client(),
+		Host:   srv.URL,
+		Auth: &xrpc.AuthInfo{
+			AccessJwt:  accessJwt,
+			RefreshJwt: refreshJwt,
+			Did:        did,
+		},
+	}
+}
+
+func newTestLimiter(t *testing.T) *Limiter {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	limiter := NewLimiter(ctx, 10000, time.Hour, nil)
+	go limiter.Open()
+
+	return limiter
+}
+
+func getRkeys(records []Record) []string {
+	rkeys := []string{}
+	for _, record := range records {
+		rkeys = append(rkeys, record.Rkey)
+	}
+
+	return rkeys
+}
+
+func getRemainingRkeys(srv *bskytest.Server, did string) []string {
+	rkeys := []string{}
+	for _, post := range srv.Posts(did) {
+		rkeys = append(rkeys, post.Rkey)
+	}
+
+	return rkeys
+}
+
+func TestGetPostsToDeleteResumesAtFirstUnexpiredPost(t *testing.T) {
+	srv, did, rkeys, client := newTestServer(t, expired, expired, expired, expired, expired, unexpired, unexpired, unexpired, unexpired)
+	limiter := newTestLimiter(t)
+
+	posts, cursor, err := GetPostsToDelete(context.Background(), client, 1, "", 3, 100, limiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := rkeys[:5]; !reflect.DeepEqual(getRkeys(posts), want) {
+		t.Fatalf("got posts %v, want %v", getRkeys(posts), want)
+	}
+
+	// The first unexpired post is in the middle of the second page
+	if cursor != rkeys[4] {
+		t.Fatalf("got cursor %q, want %q", cursor, rkeys[4])
+	}
+
+	// The rest of the second page must not be skipped once its posts expire
+	srv.SetPostCreatedAt(did, rkeys[5], time.Now().Add(-expired))
+	srv.SetPostCreatedAt(did, rkeys[6], time.Now().Add(-expired))
+
+	posts, cursor, err = GetPostsToDelete(context.Background(), client, 1, cursor, 3, 100, limiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := rkeys[5:7]; !reflect.DeepEqual(getRkeys(posts), want) {
+		t.Fatalf("got posts %v, want %v", getRkeys(posts), want)
+	}
+
+	if cursor != rkeys[6] {
+		t.Fatalf("got cursor %q, want %q", cursor, rkeys[6])
+	}
+}
+
+func TestGetPostsToDeleteKeepsCursorIfNoPostHasExpired(t *testing.T) {
+	_, _, rkeys, client := newTestServer(t, expired, expired, unexpired, unexpired)
+	limiter := newTestLimiter(t)
+
+	posts, cursor, err := GetPostsToDelete(context.Background(), client, 1, rkeys[1], 2, 100, limiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posts) != 0 {
+		t.Fatalf("got posts %v, want none", getRkeys(posts))
+	}
+
+	if cursor != rkeys[1] {
+		t.Fatalf("got cursor %q, want %q", cursor, rkeys[1])
+	}
+}
+
+func TestGetPostsToDeleteFindsNewPostsAfterLastPost(t *testing.T) {
+	srv, did, rkeys, client := newTestServer(t, expired, expired, expired, expired)
+	limiter := newTestLimiter(t)
+
+	posts, cursor, err := GetPostsToDelete(context.Background(), client, 1, "", 2, 100, limiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := rkeys; !reflect.DeepEqual(getRkeys(posts), want) {
+		t.Fatalf("got posts %v, want %v", getRkeys(posts), want)
+	}
+
+	if cursor != rkeys[3] {
+		t.Fatalf("got cursor %q, want %q", cursor, rkeys[3])
+	}
+
+	rkey := srv.AddPost(did, time.Now().Add(-expired))
+
+	posts, _, err = GetPostsToDelete(context.Background(), client, 1, cursor, 2, 100, limiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{rkey}; !reflect.DeepEqual(getRkeys(posts), want) {
+		t.Fatalf("got posts %v, want %v", getRkeys(posts), want)
+	}
+}
+
+func TestGetPostsToDeleteReturnsErrorForUnexpectedStatus(t *testing.T) {
+	srv, _, _, client := newTestServer(t, expired, expired)
+	limiter := newTestLimiter(t)
+
+	srv.InjectFault(bskytest.Fault{
+		Method: bskytest.MethodListRecords,
+		Status: http.StatusInternalServerError,
+		Error:  "InternalServerError",
+	})
+
+	if _, _, err := GetPostsToDelete(context.Background(), client, 1, "", 2, 100, limiter); !errors.Is(err, ErrUnexpectedStatus) {
+		t.Fatalf("got error %v, want %v", err, ErrUnexpectedStatus)
+	}
+}
+
+func TestSweepPostsCommitsCursorAfterEachPage(t *testing.T) {
+	srv, did, rkeys, client := newTestServer(t, expired, expired, expired, expired, expired, expired, expired, unexpired, unexpired)
+	limiter := newTestLimiter(t)
+
+	commits := []string{}
+	deleted, err := SweepPosts(context.Background(), client, 1, "", 3, 100, 2, false, limiter, nil, nil, func(cursor string) error {
+		commits = append(commits, cursor)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted != 7 {
+		t.Fatalf("got %v deleted posts, want %v", deleted, 7)
+	}
+
+	if want := []string{rkeys[2], rkeys[5], rkeys[6]}; !reflect.DeepEqual(commits, want) {
+		t.Fatalf("got commits %v, want %v", commits, want)
+	}
+
+	if want := rkeys[7:]; !reflect.DeepEqual(getRemainingRkeys(srv, did), want) {
+		t.Fatalf("got remaining posts %v, want %v", getRemainingRkeys(srv, did), want)
+	}
+}
+
+func TestSweepPostsResumesAfterLastDeletedPost(t *testing.T) {
+	srv, did, rkeys, client := newTestServer(t, expired, expired, expired, expired, expired, unexpired)
+	limiter := newTestLimiter(t)
+
+	srv.InjectFault(bskytest.Fault{
+		Method: bskytest.MethodApplyWrites,
+		Skip:   1,
+		Times:  1,
+		Status: http.StatusInternalServerError,
+		Error:  "InternalServerError",
+	})
+
+	cursor := ""
+	commit := func(c string) error {
+		cursor = c
+
+		return nil
+	}
+
+	deleted, err := SweepPosts(context.Background(), client, 1, cursor, 4, 100, 2, false, limiter, nil, nil, commit)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if deleted != 2 {
+		t.Fatalf("got %v deleted posts, want %v", deleted, 2)
+	}
+
+	if cursor != rkeys[1] {
+		t.Fatalf("got cursor %q, want %q", cursor, rkeys[1])
+	}
+
+	deleted, err = SweepPosts(context.Background(), client, 1, cursor, 4, 100, 2, false, limiter, nil, nil, commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted != 3 {
+		t.Fatalf("got %v deleted posts, want %v", deleted, 3)
+	}
+
+	if want := rkeys[5:]; !reflect.DeepEqual(getRemainingRkeys(srv, did), want) {
+		t.Fatalf("got remaining posts %v, want %v", getRemainingRkeys(srv, did), want)
+	}
+
+	if cursor != rkeys[4] {
+		t.Fatalf("got cursor %q, want %q", cursor, rkeys[4])
+	}
+}
@@ -0,0 +1,148 @@
+package bluesky
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	didMethodPLC = "did:plc:"
+	didMethodWeb = "did:web:"
+
+	serviceIDPDS   = "#atproto_pds"
+	serviceTypePDS = "AtprotoPersonalDataServer"
+
+	maxDIDDocumentSize = 1024 * 1024 // did:web documents are served by users, so they must not be able to stream unbounded documents
+)
+
+var (
+	ErrUnsupportedDIDMethod = errors.New("unsupported DID method")
+	ErrInvalidDID           = errors.New("invalid DID")
+	ErrMissingPDSEndpoint   = errors.New("missing PDS endpoint in DID document")
+
+	errCouldNotResolveDIDDocument = errors.New("could not resolve DID document")
+)
+
+type DIDDocument struct {
+	ID      string       `json:"id"`
+	Service []DIDService `json:"service"`
+}
+
+type DIDService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+func ResolveDIDDocument(
+	ctx context.Context,
+
+	httpClient *http.Client,
+
+	plcDirectoryURL string,
+	did string,
+) (*DIDDocument, error) {
+	var rawURL string
+	switch {
+	case strings.HasPrefix(did, didMethodPLC):
+		u, err := url.JoinPath(plcDirectoryURL, did)
+		if err != nil {
+			return nil, err
+		}
+
+		rawURL = u
+
+	case strings.HasPrefix(did, didMethodWeb):
+		// Only hostname-level did:web DIDs are valid for atproto, so path segments (separated by colons) are rejected (see https://atproto.com/specs/did#blessed-did-methods)
+		rawHost := strings.TrimPrefix(did, didMethodWeb)
+		if strings.TrimSpace(rawHost) == "" || strings.Contains(rawHost, ":") {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDID, did)
+		}
+
+		host, err := url.PathUnescape(rawHost) // Ports are percent-encoded
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDID, err)
+		}
+
+		if strings.Contains(host, "/") {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDID, did)
+		}
+
+		rawURL = (&url.URL{
+			Scheme: "https",
+			Host:   host,
+			Path:   "/.well-known/did.json",
+		}).String()
+
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedDIDMethod, did)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/did+ld+json, application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %v", errCouldNotResolveDIDDocument, resp.Status)
+	}
+
+	var doc DIDDocument
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDIDDocumentSize)).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	if doc.ID != did {
+		return nil, fmt.Errorf("%w: document ID %v does not match %v", errCouldNotResolveDIDDocument, doc.ID, did)
+	}
+
+	return &doc, nil
+}
+
+func (d *DIDDocument) GetPDSEndpoint() (string, error) {
+	for _, service := range d.Service {
+		if (service.ID == serviceIDPDS || service.ID == d.ID+serviceIDPDS) && service.Type == serviceTypePDS {
+			u, err := url.Parse(service.ServiceEndpoint)
+			if err != nil {
+				return "", err
+			}
+
+			if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return "", fmt.Errorf("%w: invalid endpoint %v", ErrMissingPDSEndpoint, service.ServiceEndpoint)
+			}
+
+			return strings.TrimSuffix(u.String(), "/"), nil
+		}
+	}
+
+	return "", ErrMissingPDSEndpoint
+}
+
+func ResolvePDS(
+	ctx context.Context,
+
+	httpClient *http.Client,
+
+	plcDirectoryURL string,
+	did string,
+) (string, error) {
+	doc, err := ResolveDIDDocument(ctx, httpClient, plcDirectoryURL, did)
+	if err != nil {
+		return "", err
+	}
+
+	return doc.GetPDSEndpoint()
+}
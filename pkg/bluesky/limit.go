@@ -2,8 +2,12 @@ package bluesky
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -14,6 +18,15 @@ const (
 	PointsGet = 1 // Technically not specified, so its assumed that its the equivalent of delete (see https://atproto.com/blog/rate-limits-pds-v3)
 )
 
+var (
+	ErrBudgetExhausted = errors.New("budget exhausted")
+)
+
+// Spender spends rate limit points before an API call
+type Spender interface {
+	Spend(ctx context.Context, points int) error
+}
+
 type Limiter struct {
 	ctx context.Context
 
@@ -72,8 +85,14 @@ func (l *Limiter) Open() {
 	}
 }
 
-func (l *Limiter) Spend(points int) error {
+func (l *Limiter) Spend(ctx context.Context, points int) error {
 	l.pointsLock.L.Lock()
+	defer l.pointsLock.L.Unlock()
+
+	if l.availablePoints < 0 {
+		return context.Canceled // Context cancelled, so there won't be another reset to wait for
+	}
+
 	if l.availablePoints-points <= 0 {
 		if l.onWaitingForReset != nil {
 			if err := l.onWaitingForReset(); err != nil {
@@ -81,7 +100,19 @@ func (l *Limiter) Spend(points int) error {
 			}
 		}
 
+		span := trace.SpanFromContext(ctx)
+		span.AddEvent("Limiter.wait", trace.WithAttributes(
+			attribute.Int("points", points),
+			attribute.Int("availablePoints", l.availablePoints),
+		))
+
+		before := time.Now()
+
 		l.pointsLock.Wait()
+
+		span.AddEvent("Limiter.resumed", trace.WithAttributes(
+			attribute.Int64("waitedMilliseconds", time.Since(before).Milliseconds()),
+		))
 	}
 
 	if l.availablePoints < 0 {
@@ -91,8 +122,6 @@ func (l *Limiter) Spend(points int) error {
 	l.availablePoints -= points
 	l.spentPoints += points
 
-	l.pointsLock.L.Unlock()
-
 	return nil
 }
 
@@ -102,3 +131,45 @@ func (l *Limiter) GetSpendPoints() int {
 
 	return l.spentPoints
 }
+
+// Budget caps the points spent through it, e.g. on a single DID, in addition to the spender it spends them with
+type Budget struct {
+	spender Spender
+
+	availablePoints int
+	spentPoints     int
+	pointsLock      sync.Mutex
+}
+
+func NewBudget(spender Spender, points int) *Budget {
+	return &Budget{
+		spender: spender,
+
+		availablePoints: points,
+	}
+}
+
+// Spend returns ErrBudgetExhausted without spending anything if the points exceed the rest of the budget
+func (b *Budget) Spend(ctx context.Context, points int) error {
+	b.pointsLock.Lock()
+	defer b.pointsLock.Unlock()
+
+	if b.spentPoints+points > b.availablePoints {
+		return ErrBudgetExhausted
+	}
+
+	if err := b.spender.Spend(ctx, points); err != nil {
+		return err
+	}
+
+	b.spentPoints += points
+
+	return nil
+}
+
+func (b *Budget) GetSpendPoints() int {
+	b.pointsLock.Lock()
+	defer b.pointsLock.Unlock()
+
+	return b.spentPoints
+}
@@ -0,0 +1,221 @@
+package bluesky
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidService    = errors.New("invalid service")
+	ErrServiceNotAllowed = errors.New("service not allowed")
+	ErrPrivateAddress    = errors.New("service resolves to a private, loopback or link-local address")
+
+	errInvalidJWT = errors.New("invalid JWT")
+
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10") // Carrier-grade NAT (see RFC 6598)
+)
+
+type ServicePolicy struct {
+	allowlist    []string
+	denylist     []string
+	allowPrivate bool
+}
+
+// NewServicePolicy creates a policy for service URLs supplied by untrusted callers.
+// Allow- and denylist entries are hostnames, optionally prefixed with `*.` to match all subdomains;
+// an empty allowlist allows all hosts that aren't denied.
+func NewServicePolicy(
+	allowlist []string,
+	denylist []string,
+	allowPrivate bool,
+) *ServicePolicy {
+	return &ServicePolicy{
+		allowlist:    normalizeHostPatterns(allowlist),
+		denylist:     normalizeHostPatterns(denylist),
+		allowPrivate: allowPrivate,
+	}
+}
+
+func (p *ServicePolicy) Validate(ctx context.Context, service string) error {
+	u, err := url.Parse(service)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidService, err)
+	}
+
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidService, service)
+	}
+
+	// Plain HTTP is only used by local development PDSes
+	if u.Scheme == "http" && !p.allowPrivate {
+		return fmt.Errorf("%w: %v does not use HTTPS", ErrServiceNotAllowed, service)
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+
+	for _, pattern := range p.denylist {
+		if matchesHostPattern(pattern, host) {
+			return fmt.Errorf("%w: %v is denylisted", ErrServiceNotAllowed, host)
+		}
+	}
+
+	if len(p.allowlist) > 0 {
+		allowed := false
+		for _, pattern := range p.allowlist {
+			if matchesHostPattern(pattern, host) {
+				allowed = true
+
+				break
+			}
+		}
+
+		if !allowed {
+			return fmt.Errorf("%w: %v is not allowlisted", ErrServiceNotAllowed, host)
+		}
+	}
+
+	if p.allowPrivate {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidService, err)
+	}
+
+	for _, addr := range addrs {
+		if isPrivateAddress(addr) {
+			return fmt.Errorf("%w: %v resolves to %v", ErrPrivateAddress, host, addr)
+		}
+	}
+
+	return nil
+}
+
+// NewHTTPClient returns a HTTP client which re-checks the resolved address on every connection,
+// which prevents DNS rebinding between `Validate` and the actual request
+func (p *ServicePolicy) NewHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   p.controlDial,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// controlDial rejects connections to private addresses after they have been resolved
+func (p *ServicePolicy) controlDial(network, address string, c syscall.RawConn) error {
+	if p.allowPrivate {
+		return nil
+	}
+
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	if isPrivateAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %v", ErrPrivateAddress, addrPort.Addr())
+	}
+
+	return nil
+}
+
+// GetDIDFromJWT returns the subject of an atproto access or refresh JWT without verifying its signature,
+// which can only be trusted once the PDS has accepted the JWT
+func GetDIDFromJWT(jwt string) (string, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return "", errInvalidJWT
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidJWT, err)
+	}
+
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidJWT, err)
+	}
+
+	if strings.TrimSpace(claims.Sub) == "" {
+		return "", fmt.Errorf("%w: missing subject", errInvalidJWT)
+	}
+
+	return claims.Sub, nil
+}
+
+// ServicesEqual compares two service URLs while ignoring trailing slashes and case in the host
+func ServicesEqual(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return ua.Scheme == ub.Scheme &&
+		strings.EqualFold(ua.Host, ub.Host) &&
+		strings.TrimSuffix(ua.Path, "/") == strings.TrimSuffix(ub.Path, "/")
+}
+
+func normalizeHostPatterns(patterns []string) []string {
+	normalized := []string{}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+		if pattern == "" {
+			continue
+		}
+
+		normalized = append(normalized, pattern)
+	}
+
+	return normalized
+}
+
+func matchesHostPattern(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+
+	return pattern == host
+}
+
+func isPrivateAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() ||
+		sharedAddressSpace.Contains(addr)
+}
@@ -0,0 +1,315 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+
+	EventDIDStarted   = "didStarted"
+	EventPostsListed  = "postsListed"
+	EventBatchDeleted = "batchDeleted"
+	EventDIDFinished  = "didFinished"
+	EventThrottled    = "throttled"
+	EventFinished     = "finished"
+
+	subscriberBufferSize = 64
+)
+
+var (
+	ErrBusy = errors.New("another job which doesn't cover the request is running")
+)
+
+type Progress struct {
+	DIDsTotal    int `json:"didsTotal"`
+	DIDsDone     int `json:"didsDone"`
+	SpentPoints  int `json:"spentPoints"`
+	Throttled    int `json:"throttled"`
+	PostsDeleted int `json:"postsDeleted"`
+}
+
+// Event describes a step of a running job; fields that don't apply to the event type are omitted
+type Event struct {
+	Type string `json:"type"`
+
+	DID          string `json:"did,omitempty"`
+	Posts        int    `json:"posts,omitempty"`
+	PostsDeleted int    `json:"postsDeleted,omitempty"`
+	PostsTotal   int    `json:"postsTotal,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	Progress Progress `json:"progress"`
+}
+
+type Snapshot struct {
+	ID         string     `json:"id"`
+	DID        string     `json:"did,omitempty"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Progress   Progress   `json:"progress"`
+}
+
+type Job struct {
+	id  string
+	did string
+
+	lock       sync.Mutex
+	status     string
+	startedAt  time.Time
+	finishedAt *time.Time
+	err        error
+	progress   Progress
+
+	subscribers map[chan Event]struct{}
+
+	done chan struct{}
+}
+
+func (j *Job) ID() string {
+	return j.id
+}
+
+// Update changes the progress of the job
+func (j *Job) Update(fn func(p *Progress)) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	fn(&j.progress)
+}
+
+func (j *Job) Snapshot() Snapshot {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	s := Snapshot{
+		ID:         j.id,
+		DID:        j.did,
+		Status:     j.status,
+		StartedAt:  j.startedAt,
+		FinishedAt: j.finishedAt,
+		Progress:   j.progress,
+	}
+
+	if j.err != nil {
+		s.Error = j.err.Error()
+	}
+
+	return s
+}
+
+// Publish sends event to all subscribers; subscribers which can't keep up miss events
+// instead of blocking the job
+func (j *Job) Publish(event Event) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.publish(event)
+}
+
+func (j *Job) publish(event Event) {
+	event.Progress = j.progress
+
+	for subscriber := range j.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function to unsubscribe; the channel is
+// closed once the job has finished, after a final `finished` event has been sent
+func (j *Job) Subscribe() (<-chan Event, func()) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	events := make(chan Event, subscriberBufferSize)
+
+	select {
+	case <-j.done:
+		close(events)
+
+		return events, func() {}
+	default:
+	}
+
+	j.subscribers[events] = struct{}{}
+
+	return events, func() {
+		j.lock.Lock()
+		defer j.lock.Unlock()
+
+		if _, ok := j.subscribers[events]; ok {
+			delete(j.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Done is closed once the job has finished
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *Job) finish(err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	now := time.Now()
+	j.finishedAt = &now
+	j.err = err
+
+	event := Event{
+		Type: EventFinished,
+	}
+
+	if err != nil {
+		j.status = StatusFailed
+		event.Error = err.Error()
+	} else {
+		j.status = StatusSucceeded
+	}
+
+	j.publish(event)
+
+	for subscriber := range j.subscribers {
+		delete(j.subscribers, subscriber)
+		close(subscriber)
+	}
+
+	close(j.done)
+}
+
+// Runner runs at most one job at a time and remembers the most recent finished jobs
+type Runner struct {
+	lock    sync.Mutex
+	jobs    map[string]*Job
+	order   []string
+	current *Job
+	retain  int
+
+	wg sync.WaitGroup
+}
+
+func NewRunner(retain int) *Runner {
+	return &Runner{
+		jobs:   map[string]*Job{},
+		order:  []string{},
+		retain: retain,
+	}
+}
+
+// Start runs run in the background with ctx unless a job is already running, in which case the running job
+// is returned instead; the second return value is true if a new job has been started. If the running job
+// only affects a single DID, it doesn't cover the request, so it is returned together with ErrBusy.
+func (r *Runner) Start(ctx context.Context, run func(ctx context.Context, job *Job) error) (*Job, bool, error) {
+	return r.StartDID(ctx, "", run)
+}
+
+// StartDID is like Start, but records that the job only affects did; a running job is only returned
+// without ErrBusy if it affects all DIDs or the same DID
+func (r *Runner) StartDID(ctx context.Context, did string, run func(ctx context.Context, job *Job) error) (*Job, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.current != nil {
+		if r.current.did != "" && r.current.did != did {
+			return r.current, false, ErrBusy
+		}
+
+		return r.current, false, nil
+	}
+
+	job := &Job{
+		id:        uuid.NewString(),
+		did:       did,
+		status:    StatusRunning,
+		startedAt: time.Now(),
+
+		subscribers: map[chan Event]struct{}{},
+
+		done: make(chan struct{}),
+	}
+
+	r.jobs[job.id] = job
+	r.order = append(r.order, job.id)
+	r.current = job
+
+	for len(r.order) > r.retain && len(r.order) > 1 {
+		delete(r.jobs, r.order[0])
+		r.order = r.order[1:]
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		err := run(ctx, job)
+
+		r.lock.Lock()
+		r.current = nil
+		r.lock.Unlock()
+
+		job.finish(err)
+	}()
+
+	return job, true, nil
+}
+
+func (r *Runner) Get(id string) (*Job, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	job, ok := r.jobs[id]
+
+	return job, ok
+}
+
+// List returns snapshots of the running and the remembered finished jobs, newest first
+func (r *Runner) List() []Snapshot {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	snapshots := []Snapshot{}
+	for i := len(r.order) - 1; i >= 0; i-- {
+		snapshots = append(snapshots, r.jobs[r.order[i]].Snapshot())
+	}
+
+	return snapshots
+}
+
+// Running returns whether a job is currently running
+func (r *Runner) Running() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.current != nil
+}
+
+// Wait waits for all jobs to finish or for ctx to be cancelled
+func (r *Runner) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,85 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// startBlocked starts a job for did which runs until the returned function is called
+func startBlocked(t *testing.T, r *Runner, did string) (*Job, func()) {
+	t.Helper()
+
+	release := make(chan struct{})
+	job, created, err := r.StartDID(context.Background(), did, func(ctx context.Context, job *Job) error {
+		<-release
+
+		return nil
+	})
+	if err != nil || !created {
+		t.Fatalf("got created %v and error %v for first job, want a new job", created, err)
+	}
+
+	return job, func() {
+		close(release)
+
+		<-job.Done()
+	}
+}
+
+func TestRunnerOnlyReturnsRunningJobIfItCoversRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		runningDID string
+		did        string
+		wantErr    error
+	}{
+		{"same DID", "did:plc:alice", "did:plc:alice", nil},
+		{"DID during sweep of all DIDs", "", "did:plc:alice", nil},
+		{"all DIDs during sweep of all DIDs", "", "", nil},
+		{"other DID", "did:plc:alice", "did:plc:bob", ErrBusy},
+		{"all DIDs during sweep of DID", "did:plc:alice", "", ErrBusy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRunner(10)
+
+			running, release := startBlocked(t, r, tt.runningDID)
+			defer release()
+
+			job, created, err := r.StartDID(context.Background(), tt.did, func(ctx context.Context, job *Job) error {
+				t.Error("job has been started while another one is running")
+
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if created || job != running {
+				t.Fatalf("got created %v and job %v, want the running job %v", created, job.ID(), running.ID())
+			}
+		})
+	}
+}
+
+func TestRunnerStartsJobForOtherDIDOnceRunningJobHasFinished(t *testing.T) {
+	r := NewRunner(10)
+
+	_, release := startBlocked(t, r, "did:plc:alice")
+	release()
+
+	job, created, err := r.StartDID(context.Background(), "did:plc:bob", func(ctx context.Context, job *Job) error {
+		return nil
+	})
+	if err != nil || !created {
+		t.Fatalf("got created %v and error %v, want a new job", created, err)
+	}
+
+	<-job.Done()
+
+	if snapshot := job.Snapshot(); snapshot.DID != "did:plc:bob" || snapshot.Status != StatusSucceeded {
+		t.Fatalf("got job %+v, want a succeeded job for bob", snapshot)
+	}
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	redacted = "[REDACTED]"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown log format")
+	ErrUnknownLevel  = errors.New("unknown log level")
+
+	// Attributes with these keys are never logged since they contain secrets
+	sensitiveKeys = []string{
+		"accessjwt",
+		"refreshjwt",
+		"jwt",
+		"authorization",
+		"apikey",
+		"password",
+	}
+)
+
+type contextKey struct{}
+
+func New(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownLevel, level)
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       l,
+		ReplaceAttr: redactSensitive,
+	}
+
+	switch format {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, format)
+	}
+}
+
+// WithLogger returns a context which carries logger, which can be retrieved with `FromContext`
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx or the default logger if there is none
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok && logger != nil {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// With adds attributes to the logger carried by ctx
+func With(ctx context.Context, args ...any) (context.Context, *slog.Logger) {
+	logger := FromContext(ctx).With(args...)
+
+	return WithLogger(ctx, logger), logger
+}
+
+func redactSensitive(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(a.Key))
+	for _, sensitiveKey := range sensitiveKeys {
+		if key == sensitiveKey {
+			return slog.String(a.Key, redacted)
+		}
+	}
+
+	return a
+}
@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "skysweeper"
+
+	countConfigurationsTimeout = time.Second * 5
+
+	xrpcPathPrefix   = "/xrpc/"
+	otherXRPCMethods = "other"
+	otherHosts       = "other"
+)
+
+var (
+	PostsDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "posts_deleted_total",
+		Help:      "Number of posts deleted (or that would have been deleted in dry run mode)",
+	}, []string{"dry_run"})
+
+	LimiterPointsSpent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "limiter_points_spent_total",
+		Help:      "Number of rate limit points spent",
+	})
+
+	ThrottleWaits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "throttle_waits_total",
+		Help:      "Number of times a sweep paused until the rate limit reset interval",
+	})
+
+	RefreshFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refresh_failures_total",
+		Help:      "Number of sessions that could not be refreshed",
+	})
+
+	BudgetsExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "budgets_exhausted_total",
+		Help:      "Number of times the budget of a DID has been spent before all of its expired posts have been deleted",
+	})
+
+	SweepDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sweep_duration_seconds",
+		Help:      "Duration of sweeps across all enabled configurations",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10), // 1s to ~3d
+	})
+
+	PDSRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pds_requests_total",
+		Help:      "Number of requests to PDSes by host, XRPC method and status code",
+	}, []string{"host", "method", "code"})
+
+	PDSRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pds_request_duration_seconds",
+		Help:      "Latency of requests to PDSes by host and XRPC method",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "method"})
+
+	// Hosts and paths of other requests (e.g. DID documents) are chosen by users, so only these are used as labels
+	knownHosts = []string{
+		"bsky.social",
+		"*.host.bsky.network",
+	}
+
+	knownXRPCMethods = map[string]struct{}{
+		"com.atproto.repo.applyWrites":      {},
+		"com.atproto.repo.listRecords":      {},
+		"com.atproto.server.createSession":  {},
+		"com.atproto.server.getSession":     {},
+		"com.atproto.server.refreshSession": {},
+	}
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests handled by handler, method and status code",
+	}, []string{"handler", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests handled by handler and method",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "method"})
+
+	enabledConfigurationsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "configurations_enabled"),
+		"Number of enabled configurations",
+		nil, nil,
+	)
+
+	disabledByFailureConfigurationsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "configurations_disabled_by_failure"),
+		"Number of configurations that have been disabled because their session could not be refreshed",
+		nil, nil,
+	)
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// InstrumentHandler counts and times requests to a HTTP handler
+func InstrumentHandler(name string, handler http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(
+		httpRequestDuration.MustCurryWith(prometheus.Labels{"handler": name}),
+		promhttp.InstrumentHandlerCounter(
+			httpRequests.MustCurryWith(prometheus.Labels{"handler": name}),
+			handler,
+		),
+	)
+}
+
+type transport struct {
+	base  http.RoundTripper
+	hosts []string
+}
+
+// NewTransport wraps a HTTP transport to count and time requests to PDSes. Requests are labeled with
+// their host if it is a known entryway or PDS, or one of hosts (e.g. the service allowlist), which
+// supports `*.` prefixes to match all subdomains; all other hosts are labeled as "other".
+func NewTransport(base http.RoundTripper, hosts []string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	patterns := append([]string{}, knownHosts...)
+	for _, host := range hosts {
+		if host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), ".")); host != "" {
+			patterns = append(patterns, host)
+		}
+	}
+
+	return &transport{base, patterns}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := t.getHost(req.URL.Hostname())
+	method := getXRPCMethod(req.URL.Path)
+
+	before := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	PDSRequestDuration.WithLabelValues(host, method).Observe(time.Since(before).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	PDSRequests.WithLabelValues(host, method, code).Inc()
+
+	return resp, err
+}
+
+// getHost returns host if it is one of the known hosts, the matching pattern if host is a subdomain
+// of a `*.` pattern and "other" otherwise, which keeps the cardinality of the host label bounded
+func (t *transport) getHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, pattern := range t.hosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return pattern
+			}
+
+			continue
+		}
+
+		if pattern == host {
+			return host
+		}
+	}
+
+	return otherHosts
+}
+
+// getXRPCMethod returns the XRPC method of path if it is a known one and "other" otherwise,
+// which keeps the cardinality of the method label bounded
+func getXRPCMethod(path string) string {
+	method, ok := strings.CutPrefix(path, xrpcPathPrefix)
+	if !ok {
+		return otherXRPCMethods
+	}
+
+	if _, ok := knownXRPCMethods[method]; !ok {
+		return otherXRPCMethods
+	}
+
+	return method
+}
+
+type configurationsCollector struct {
+	countConfigurations func(ctx context.Context) (models.CountConfigurationsRow, error)
+}
+
+// RegisterConfigurationsCollector exposes configuration counts as gauges, which are queried on every scrape
+func RegisterConfigurationsCollector(countConfigurations func(ctx context.Context) (models.CountConfigurationsRow, error)) error {
+	return prometheus.Register(&configurationsCollector{countConfigurations})
+}
+
+func (c *configurationsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- enabledConfigurationsDesc
+	ch <- disabledByFailureConfigurationsDesc
+}
+
+func (c *configurationsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), countConfigurationsTimeout)
+	defer cancel()
+
+	counts, err := c.countConfigurations(ctx)
+	if err != nil {
+		slog.Warn("Could not count configurations for metrics, skipping", "err", err)
+
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(enabledConfigurationsDesc, prometheus.GaugeValue, float64(counts.Enabled))
+	ch <- prometheus.MustNewConstMetric(disabledByFailureConfigurationsDesc, prometheus.GaugeValue, float64(counts.DisabledByFailure))
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGetXRPCMethodOnlyReturnsKnownMethods(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/xrpc/com.atproto.repo.listRecords", "com.atproto.repo.listRecords"},
+		{"/xrpc/com.atproto.server.refreshSession", "com.atproto.server.refreshSession"},
+		{"/xrpc/com.example.unknown", otherXRPCMethods},
+		{"/did:plc:ewvi7nxzyoun6zhxrhs64oiz", otherXRPCMethods},
+		{"/.well-known/did.json", otherXRPCMethods},
+		{"/", otherXRPCMethods},
+	}
+
+	for _, tt := range tests {
+		if got := getXRPCMethod(tt.path); got != tt.want {
+			t.Errorf("got method %v for %v, want %v", got, tt.path, tt.want)
+		}
+	}
+}
+
+func TestTransportOnlyLabelsKnownHosts(t *testing.T) {
+	tr := NewTransport(nil, []string{"PDS.example.com.", "*.pds.example.org"}).(*transport)
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"bsky.social", "bsky.social"},
+		{"morel.us-east.host.bsky.network", "*.host.bsky.network"},
+		{"pds.example.com", "pds.example.com"},
+		{"PDS.Example.com.", "pds.example.com"},
+		{"a.pds.example.org", "*.pds.example.org"},
+		{"pds.example.org", otherHosts},
+		{"attacker.example.net", otherHosts},
+		{"127.0.0.1", otherHosts},
+	}
+
+	for _, tt := range tests {
+		if got := tr.getHost(tt.host); got != tt.want {
+			t.Errorf("got host %v for %v, want %v", got, tt.host, tt.want)
+		}
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransportLabelsRequestsByHostAndMethod(t *testing.T) {
+	tr := NewTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}), []string{"pds.example.com"})
+
+	requests := []struct {
+		url    string
+		host   string
+		method string
+	}{
+		{"https://pds.example.com/xrpc/com.atproto.repo.listRecords", "pds.example.com", "com.atproto.repo.listRecords"},
+		{"https://attacker.example.net/xrpc/com.atproto.repo.listRecords", otherHosts, "com.atproto.repo.listRecords"},
+		{"https://attacker.example.net/did:plc:ewvi7nxzyoun6zhxrhs64oiz", otherHosts, otherXRPCMethods},
+	}
+
+	for _, r := range requests {
+		before := testutil.ToFloat64(PDSRequests.WithLabelValues(r.host, r.method, "200"))
+
+		req, err := http.NewRequest(http.MethodGet, r.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := testutil.ToFloat64(PDSRequests.WithLabelValues(r.host, r.method, "200")) - before; got != 1 {
+			t.Errorf("got %v requests with host %v and method %v for %v, want 1", got, r.host, r.method, r.url)
+		}
+	}
+}
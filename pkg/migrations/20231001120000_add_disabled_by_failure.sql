@@ -0,0 +1,5 @@
+-- +goose Up
+alter table configurations
+add column disabled_by_failure boolean not null default false;
+-- +goose Down
+alter table configurations drop column disabled_by_failure;
\ No newline at end of file
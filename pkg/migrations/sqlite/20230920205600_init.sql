@@ -0,0 +1,11 @@
+-- +goose Up
+create table configurations (
+    did text not null primary key,
+    service text not null,
+    refresh_jwt text not null,
+    cursor text not null,
+    enabled boolean not null,
+    post_ttl integer not null check (post_ttl > 0)
+);
+-- +goose Down
+drop table configurations;
\ No newline at end of file
@@ -0,0 +1,11 @@
+-- +goose Up
+alter table configurations
+add column points_spent integer not null default 0;
+alter table configurations
+add column backlog_pending boolean not null default false;
+alter table configurations
+add column last_swept_at datetime;
+-- +goose Down
+alter table configurations drop column last_swept_at;
+alter table configurations drop column backlog_pending;
+alter table configurations drop column points_spent;
\ No newline at end of file
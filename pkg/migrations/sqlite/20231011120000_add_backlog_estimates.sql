@@ -0,0 +1,8 @@
+-- +goose Up
+alter table configurations
+add column posts_pending integer not null default 0;
+alter table configurations
+add column last_swept_posts integer not null default 0;
+-- +goose Down
+alter table configurations drop column last_swept_posts;
+alter table configurations drop column posts_pending;
\ No newline at end of file
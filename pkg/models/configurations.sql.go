@@ -7,8 +7,33 @@ package models
 
 import (
 	"context"
+	"database/sql"
 )
 
+const countConfigurations = `-- name: CountConfigurations :one
+select count(*) filter (
+        where enabled
+    ) as enabled,
+    count(*) filter (
+        where disabled_by_failure
+    ) as disabled_by_failure,
+    count(*) as total
+from configurations
+`
+
+type CountConfigurationsRow struct {
+	Enabled           int64
+	DisabledByFailure int64
+	Total             int64
+}
+
+func (q *Queries) CountConfigurations(ctx context.Context) (CountConfigurationsRow, error) {
+	row := q.db.QueryRowContext(ctx, countConfigurations)
+	var i CountConfigurationsRow
+	err := row.Scan(&i.Enabled, &i.DisabledByFailure, &i.Total)
+	return i, err
+}
+
 const deleteConfiguration = `-- name: DeleteConfiguration :exec
 delete from configurations
 where did = $1
@@ -21,7 +46,8 @@ func (q *Queries) DeleteConfiguration(ctx context.Context, did string) error {
 
 const disableConfiguration = `-- name: DisableConfiguration :exec
 update configurations
-set enabled = false
+set enabled = false,
+    disabled_by_failure = true
 where did = $1
 `
 
@@ -31,7 +57,7 @@ func (q *Queries) DisableConfiguration(ctx context.Context, did string) error {
 }
 
 const getConfiguration = `-- name: GetConfiguration :one
-select did, service, refresh_jwt, cursor, enabled, post_ttl
+select did, service, refresh_jwt, cursor, enabled, post_ttl, disabled_by_failure, points_spent, backlog_pending, last_swept_at, posts_pending, last_swept_posts
 from configurations
 where did = $1
 `
@@ -46,12 +72,109 @@ func (q *Queries) GetConfiguration(ctx context.Context, did string) (Configurati
 		&i.Cursor,
 		&i.Enabled,
 		&i.PostTtl,
+		&i.DisabledByFailure,
+		&i.PointsSpent,
+		&i.BacklogPending,
+		&i.LastSweptAt,
+		&i.PostsPending,
+		&i.LastSweptPosts,
 	)
 	return i, err
 }
 
+const getConfigurations = `-- name: GetConfigurations :many
+select did, service, refresh_jwt, cursor, enabled, post_ttl, disabled_by_failure, points_spent, backlog_pending, last_swept_at, posts_pending, last_swept_posts
+from configurations
+order by did
+`
+
+func (q *Queries) GetConfigurations(ctx context.Context) ([]Configuration, error) {
+	rows, err := q.db.QueryContext(ctx, getConfigurations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Configuration
+	for rows.Next() {
+		var i Configuration
+		if err := rows.Scan(
+			&i.Did,
+			&i.Service,
+			&i.RefreshJwt,
+			&i.Cursor,
+			&i.Enabled,
+			&i.PostTtl,
+			&i.DisabledByFailure,
+			&i.PointsSpent,
+			&i.BacklogPending,
+			&i.LastSweptAt,
+			&i.PostsPending,
+			&i.LastSweptPosts,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getConfigurationsPage = `-- name: GetConfigurationsPage :many
+select did, service, refresh_jwt, cursor, enabled, post_ttl, disabled_by_failure, points_spent, backlog_pending, last_swept_at, posts_pending, last_swept_posts
+from configurations
+where did > $1
+order by did
+limit $2
+`
+
+type GetConfigurationsPageParams struct {
+	Did   string
+	Limit int32
+}
+
+func (q *Queries) GetConfigurationsPage(ctx context.Context, arg GetConfigurationsPageParams) ([]Configuration, error) {
+	rows, err := q.db.QueryContext(ctx, getConfigurationsPage, arg.Did, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Configuration
+	for rows.Next() {
+		var i Configuration
+		if err := rows.Scan(
+			&i.Did,
+			&i.Service,
+			&i.RefreshJwt,
+			&i.Cursor,
+			&i.Enabled,
+			&i.PostTtl,
+			&i.DisabledByFailure,
+			&i.PointsSpent,
+			&i.BacklogPending,
+			&i.LastSweptAt,
+			&i.PostsPending,
+			&i.LastSweptPosts,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getEnabledConfigurations = `-- name: GetEnabledConfigurations :many
-select did, service, refresh_jwt, cursor, enabled, post_ttl
+select did, service, refresh_jwt, cursor, enabled, post_ttl, disabled_by_failure, points_spent, backlog_pending, last_swept_at, posts_pending, last_swept_posts
 from configurations
 where enabled = true
 `
@@ -72,6 +195,12 @@ func (q *Queries) GetEnabledConfigurations(ctx context.Context) ([]Configuration
 			&i.Cursor,
 			&i.Enabled,
 			&i.PostTtl,
+			&i.DisabledByFailure,
+			&i.PointsSpent,
+			&i.BacklogPending,
+			&i.LastSweptAt,
+			&i.PostsPending,
+			&i.LastSweptPosts,
 		); err != nil {
 			return nil, err
 		}
@@ -86,6 +215,115 @@ func (q *Queries) GetEnabledConfigurations(ctx context.Context) ([]Configuration
 	return items, nil
 }
 
+const patchConfiguration = `-- name: PatchConfiguration :one
+update configurations
+set service = $1,
+    refresh_jwt = $2,
+    enabled = coalesce($3, enabled),
+    post_ttl = coalesce($4, post_ttl),
+    cursor = case
+        when $4 < post_ttl then ''
+        else cursor
+    end,
+    disabled_by_failure = false
+where did = $5
+returning did, service, refresh_jwt, cursor, enabled, post_ttl, disabled_by_failure, points_spent, backlog_pending, last_swept_at, posts_pending, last_swept_posts
+`
+
+type PatchConfigurationParams struct {
+	Service    string
+	RefreshJwt string
+	Enabled    sql.NullBool
+	PostTtl    sql.NullInt32
+	Did        string
+}
+
+func (q *Queries) PatchConfiguration(ctx context.Context, arg PatchConfigurationParams) (Configuration, error) {
+	row := q.db.QueryRowContext(ctx, patchConfiguration,
+		arg.Service,
+		arg.RefreshJwt,
+		arg.Enabled,
+		arg.PostTtl,
+		arg.Did,
+	)
+	var i Configuration
+	err := row.Scan(
+		&i.Did,
+		&i.Service,
+		&i.RefreshJwt,
+		&i.Cursor,
+		&i.Enabled,
+		&i.PostTtl,
+		&i.DisabledByFailure,
+		&i.PointsSpent,
+		&i.BacklogPending,
+		&i.LastSweptAt,
+		&i.PostsPending,
+		&i.LastSweptPosts,
+	)
+	return i, err
+}
+
+const resetConfigurationCursor = `-- name: ResetConfigurationCursor :one
+update configurations
+set cursor = ''
+where did = $1
+returning did, service, refresh_jwt, cursor, enabled, post_ttl, disabled_by_failure, points_spent, backlog_pending, last_swept_at, posts_pending, last_swept_posts
+`
+
+func (q *Queries) ResetConfigurationCursor(ctx context.Context, did string) (Configuration, error) {
+	row := q.db.QueryRowContext(ctx, resetConfigurationCursor, did)
+	var i Configuration
+	err := row.Scan(
+		&i.Did,
+		&i.Service,
+		&i.RefreshJwt,
+		&i.Cursor,
+		&i.Enabled,
+		&i.PostTtl,
+		&i.DisabledByFailure,
+		&i.PointsSpent,
+		&i.BacklogPending,
+		&i.LastSweptAt,
+		&i.PostsPending,
+		&i.LastSweptPosts,
+	)
+	return i, err
+}
+
+const setConfigurationEnabled = `-- name: SetConfigurationEnabled :one
+update configurations
+set enabled = $1,
+    disabled_by_failure = false
+where did = $2
+returning did, service, refresh_jwt, cursor, enabled, post_ttl, disabled_by_failure, points_spent, backlog_pending, last_swept_at, posts_pending, last_swept_posts
+`
+
+type SetConfigurationEnabledParams struct {
+	Enabled bool
+	Did     string
+}
+
+func (q *Queries) SetConfigurationEnabled(ctx context.Context, arg SetConfigurationEnabledParams) (Configuration, error) {
+	row := q.db.QueryRowContext(ctx, setConfigurationEnabled, arg.Enabled, arg.Did)
+	var i Configuration
+	err := row.Scan(
+		&i.Did,
+		&i.Service,
+		&i.RefreshJwt,
+		&i.Cursor,
+		&i.Enabled,
+		&i.PostTtl,
+		&i.DisabledByFailure,
+		&i.PointsSpent,
+		&i.BacklogPending,
+		&i.LastSweptAt,
+		&i.PostsPending,
+		&i.LastSweptPosts,
+	)
+	return i, err
+}
+
 const updateConfigurationRefreshJWTAndCursor = `-- name: UpdateConfigurationRefreshJWTAndCursor :exec
 update configurations
 set refresh_jwt = $1,
@@ -104,6 +342,53 @@ func (q *Queries) UpdateConfigurationRefreshJWTAndCursor(ctx context.Context, ar
 	return err
 }
 
+const updateConfigurationService = `-- name: UpdateConfigurationService :exec
+update configurations
+set service = $1
+where did = $2
+`
+
+type UpdateConfigurationServiceParams struct {
+	Service string
+	Did     string
+}
+
+func (q *Queries) UpdateConfigurationService(ctx context.Context, arg UpdateConfigurationServiceParams) error {
+	_, err := q.db.ExecContext(ctx, updateConfigurationService, arg.Service, arg.Did)
+	return err
+}
+
+const updateConfigurationSweepStatistics = `-- name: UpdateConfigurationSweepStatistics :exec
+update configurations
+set points_spent = points_spent + $1,
+    backlog_pending = $2,
+    posts_pending = $3,
+    last_swept_posts = $4,
+    last_swept_at = $5
+where did = $6
+`
+
+type UpdateConfigurationSweepStatisticsParams struct {
+	PointsSpent    int64
+	BacklogPending bool
+	PostsPending   int64
+	LastSweptPosts int64
+	LastSweptAt    sql.NullTime
+	Did            string
+}
+
+func (q *Queries) UpdateConfigurationSweepStatistics(ctx context.Context, arg UpdateConfigurationSweepStatisticsParams) error {
+	_, err := q.db.ExecContext(ctx, updateConfigurationSweepStatistics,
+		arg.PointsSpent,
+		arg.BacklogPending,
+		arg.PostsPending,
+		arg.LastSweptPosts,
+		arg.LastSweptAt,
+		arg.Did,
+	)
+	return err
+}
+
 const upsertConfiguration = `-- name: UpsertConfiguration :one
 insert into configurations (
         did,
@@ -119,8 +404,9 @@ set service = excluded.service,
     refresh_jwt = excluded.refresh_jwt,
     cursor = '',
     enabled = excluded.enabled,
-    post_ttl = excluded.post_ttl
-returning did, service, refresh_jwt, cursor, enabled, post_ttl
+    post_ttl = excluded.post_ttl,
+    disabled_by_failure = false
+returning did, service, refresh_jwt, cursor, enabled, post_ttl, disabled_by_failure, points_spent, backlog_pending, last_swept_at, posts_pending, last_swept_posts
 `
 
 type UpsertConfigurationParams struct {
@@ -147,6 +433,12 @@ func (q *Queries) UpsertConfiguration(ctx context.Context, arg UpsertConfigurati
 		&i.Cursor,
 		&i.Enabled,
 		&i.PostTtl,
+		&i.DisabledByFailure,
+		&i.PointsSpent,
+		&i.BacklogPending,
+		&i.LastSweptAt,
+		&i.PostsPending,
+		&i.LastSweptPosts,
 	)
 	return i, err
 }
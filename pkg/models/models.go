@@ -4,13 +4,21 @@
 
 package models
 
-import ()
+import (
+	"database/sql"
+)
 
 type Configuration struct {
-	Did        string
-	Service    string
-	RefreshJwt string
-	Cursor     string
-	Enabled    bool
-	PostTtl    int32
+	Did               string
+	Service           string
+	RefreshJwt        string
+	Cursor            string
+	Enabled           bool
+	PostTtl           int32
+	DisabledByFailure bool
+	PointsSpent       int64
+	BacklogPending    bool
+	LastSweptAt       sql.NullTime
+	PostsPending      int64
+	LastSweptPosts    int64
 }
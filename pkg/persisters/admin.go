@@ -0,0 +1,47 @@
+package persisters
+
+import (
+	"context"
+	"database/sql"
+)
+
+// AdminPersister gives operators access to all configurations; like the other persisters, it doesn't
+// run migrations when opening, but unlike them it can't apply them at all, so the schema has to be
+// migrated with the migrate command or by a server started with --auto-migrate
+type AdminPersister struct {
+	databaseURL string
+	backend     string
+	queries     Queries
+	db          *sql.DB
+}
+
+func NewAdminPersister(databaseURL string) *AdminPersister {
+	return &AdminPersister{
+		databaseURL: databaseURL,
+	}
+}
+
+func (p *AdminPersister) Open() error {
+	var err error
+	p.backend, p.db, p.queries, err = openDatabase(p.databaseURL)
+
+	return err
+}
+
+// Backend returns the database backend, which is detected from the database URL when opening the persister
+func (p *AdminPersister) Backend() string {
+	return p.backend
+}
+
+// Ready pings the database and checks whether the schema is at the expected version
+func (p *AdminPersister) Ready(ctx context.Context) (int64, error) {
+	return checkReady(ctx, p.backend, p.db)
+}
+
+func (p *AdminPersister) Close() error {
+	if p.db != nil {
+		_ = p.db.Close()
+	}
+
+	return nil
+}
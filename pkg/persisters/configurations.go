@@ -2,6 +2,8 @@ package persisters
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/pojntfx/skysweeper/pkg/models"
 )
@@ -23,6 +25,33 @@ func (p *ManagerPersister) UpsertConfiguration(
 	})
 }
 
+// PatchConfiguration only updates the given fields and keeps the cursor unless
+// the post TTL has been decreased, in which case the repo is rescanned
+func (p *ManagerPersister) PatchConfiguration(
+	ctx context.Context,
+	did string,
+	service string,
+	refreshJWT string,
+	enabled *bool,
+	postTtl *int32,
+) (models.Configuration, error) {
+	arg := models.PatchConfigurationParams{
+		Did:        did,
+		Service:    service,
+		RefreshJwt: refreshJWT,
+	}
+
+	if enabled != nil {
+		arg.Enabled = sql.NullBool{Bool: *enabled, Valid: true}
+	}
+
+	if postTtl != nil {
+		arg.PostTtl = sql.NullInt32{Int32: *postTtl, Valid: true}
+	}
+
+	return p.queries.PatchConfiguration(ctx, arg)
+}
+
 func (p *ManagerPersister) GetConfiguration(
 	ctx context.Context,
 	did string,
@@ -44,6 +73,13 @@ func (p *WorkerPersister) DisableConfiguration(
 	return p.queries.DisableConfiguration(ctx, did)
 }
 
+func (p *WorkerPersister) GetConfiguration(
+	ctx context.Context,
+	did string,
+) (models.Configuration, error) {
+	return p.queries.GetConfiguration(ctx, did)
+}
+
 func (p *WorkerPersister) GetEnabledConfigurations(
 	ctx context.Context,
 ) ([]models.Configuration, error) {
@@ -62,3 +98,107 @@ func (p *WorkerPersister) UpdateRefreshTokenAndCursor(
 		Did:        did,
 	})
 }
+
+func (p *WorkerPersister) UpdateService(
+	ctx context.Context,
+	did string,
+	service string,
+) error {
+	return p.queries.UpdateConfigurationService(ctx, models.UpdateConfigurationServiceParams{
+		Service: service,
+		Did:     did,
+	})
+}
+
+// UpdateSweepStatistics adds the rate limit points spent on did in a sweep to its total and records
+// whether the sweep has stopped before all expired posts have been deleted, how many are estimated
+// to be left and how many have been deleted in the sweep
+func (p *WorkerPersister) UpdateSweepStatistics(
+	ctx context.Context,
+	did string,
+	pointsSpent int,
+	backlogPending bool,
+	postsPending int,
+	sweptPosts int,
+	sweptAt time.Time,
+) error {
+	return p.queries.UpdateConfigurationSweepStatistics(ctx, models.UpdateConfigurationSweepStatisticsParams{
+		PointsSpent:    int64(pointsSpent),
+		BacklogPending: backlogPending,
+		PostsPending:   int64(postsPending),
+		LastSweptPosts: int64(sweptPosts),
+		LastSweptAt:    sql.NullTime{Time: sweptAt, Valid: true},
+		Did:            did,
+	})
+}
+
+func (p *ManagerPersister) CountConfigurations(
+	ctx context.Context,
+) (models.CountConfigurationsRow, error) {
+	return p.queries.CountConfigurations(ctx)
+}
+
+func (p *WorkerPersister) CountConfigurations(
+	ctx context.Context,
+) (models.CountConfigurationsRow, error) {
+	return p.queries.CountConfigurations(ctx)
+}
+
+func (p *AdminPersister) GetConfigurations(
+	ctx context.Context,
+) ([]models.Configuration, error) {
+	return p.queries.GetConfigurations(ctx)
+}
+
+// GetConfigurationsPage returns up to limit configurations ordered by DID, starting after the DID after
+func (p *AdminPersister) GetConfigurationsPage(
+	ctx context.Context,
+	after string,
+	limit int32,
+) ([]models.Configuration, error) {
+	return p.queries.GetConfigurationsPage(ctx, models.GetConfigurationsPageParams{
+		Did:   after,
+		Limit: limit,
+	})
+}
+
+func (p *AdminPersister) GetConfiguration(
+	ctx context.Context,
+	did string,
+) (models.Configuration, error) {
+	return p.queries.GetConfiguration(ctx, did)
+}
+
+// SetConfigurationEnabled enables or disables a configuration and clears whether
+// it has been disabled because of a failure
+func (p *AdminPersister) SetConfigurationEnabled(
+	ctx context.Context,
+	did string,
+	enabled bool,
+) (models.Configuration, error) {
+	return p.queries.SetConfigurationEnabled(ctx, models.SetConfigurationEnabledParams{
+		Enabled: enabled,
+		Did:     did,
+	})
+}
+
+// ResetConfigurationCursor makes the next sweep rescan the repo from its oldest post
+func (p *AdminPersister) ResetConfigurationCursor(
+	ctx context.Context,
+	did string,
+) (models.Configuration, error) {
+	return p.queries.ResetConfigurationCursor(ctx, did)
+}
+
+func (p *AdminPersister) DeleteConfiguration(
+	ctx context.Context,
+	did string,
+) error {
+	return p.queries.DeleteConfiguration(ctx, did)
+}
+
+func (p *AdminPersister) CountConfigurations(
+	ctx context.Context,
+) (models.CountConfigurationsRow, error) {
+	return p.queries.CountConfigurations(ctx)
+}
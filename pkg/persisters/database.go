@@ -0,0 +1,95 @@
+package persisters
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pojntfx/skysweeper/pkg/models"
+	sqlitemodels "github.com/pojntfx/skysweeper/pkg/models/sqlite"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	BackendPostgres = "postgres"
+	BackendSQLite   = "sqlite"
+
+	// SQLite locks the database while writing, so wait for other writers instead of failing
+	sqliteDefaultPragmas = "_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)"
+)
+
+var (
+	ErrUnsupportedDatabaseURL = errors.New("unsupported database URL")
+)
+
+// ParseDatabaseURL detects the backend from the scheme of databaseURL and returns it along with the
+// data source name for its driver. PostgreSQL URLs (`postgres://` or `postgresql://`) are passed through as-is;
+// SQLite URLs (`sqlite://` or `sqlite3://`) contain the path to the database file, e.g.
+// `sqlite:///var/lib/skysweeper/skysweeper.db` for an absolute or `sqlite://skysweeper.db` for a relative path.
+func ParseDatabaseURL(databaseURL string) (string, string, error) {
+	scheme, rest, ok := strings.Cut(databaseURL, "://")
+	if !ok {
+		return "", "", fmt.Errorf("%w: missing scheme", ErrUnsupportedDatabaseURL)
+	}
+
+	switch strings.ToLower(scheme) {
+	case "postgres", "postgresql":
+		return BackendPostgres, databaseURL, nil
+
+	case "sqlite", "sqlite3":
+		path, rawQuery, _ := strings.Cut(rest, "?")
+		if strings.TrimSpace(path) == "" {
+			return "", "", fmt.Errorf("%w: missing SQLite database path", ErrUnsupportedDatabaseURL)
+		}
+
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %v", ErrUnsupportedDatabaseURL, err)
+		}
+
+		if _, ok := query["_pragma"]; !ok {
+			if rawQuery == "" {
+				rawQuery = sqliteDefaultPragmas
+			} else {
+				rawQuery += "&" + sqliteDefaultPragmas
+			}
+		}
+
+		return BackendSQLite, path + "?" + rawQuery, nil
+
+	default:
+		return "", "", fmt.Errorf("%w: unknown scheme %v", ErrUnsupportedDatabaseURL, scheme)
+	}
+}
+
+func openDatabase(databaseURL string) (string, *sql.DB, Queries, error) {
+	backend, dsn, err := ParseDatabaseURL(databaseURL)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	switch backend {
+	case BackendSQLite:
+		db, err := sql.Open("sqlite", dsn)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		// SQLite only supports one writer at a time, and in-memory databases are per-connection
+		db.SetMaxOpenConns(1)
+
+		return backend, db, &sqliteQueries{sqlitemodels.New(db)}, nil
+
+	default:
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		return backend, db, models.New(db), nil
+	}
+}
@@ -3,47 +3,43 @@ package persisters
 //go:generate sqlc -f ../../sqlc.yaml generate
 
 import (
+	"context"
 	"database/sql"
-
-	"github.com/pojntfx/skysweeper/pkg/migrations"
-	"github.com/pojntfx/skysweeper/pkg/models"
-	"github.com/pressly/goose/v3"
-
-	_ "github.com/lib/pq"
 )
 
 type ManagerPersister struct {
-	pgaddr  string
-	queries *models.Queries
-	db      *sql.DB
+	databaseURL string
+	backend     string
+	queries     Queries
+	db          *sql.DB
 }
 
-func NewManagerPersister(pgaddr string) *ManagerPersister {
+func NewManagerPersister(databaseURL string) *ManagerPersister {
 	return &ManagerPersister{
-		pgaddr: pgaddr,
+		databaseURL: databaseURL,
 	}
 }
 
 func (p *ManagerPersister) Open() error {
 	var err error
-	p.db, err = sql.Open("postgres", p.pgaddr)
-	if err != nil {
-		return err
-	}
-
-	goose.SetBaseFS(migrations.FS)
+	p.backend, p.db, p.queries, err = openDatabase(p.databaseURL)
 
-	if err := goose.SetDialect("postgres"); err != nil {
-		return err
-	}
+	return err
+}
 
-	if err := goose.Up(p.db, "."); err != nil {
-		return err
-	}
+// Migrate applies all pending migrations
+func (p *ManagerPersister) Migrate(ctx context.Context) error {
+	return migrateUp(ctx, p.backend, p.db)
+}
 
-	p.queries = models.New(p.db)
+// Backend returns the database backend, which is detected from the database URL when opening the persister
+func (p *ManagerPersister) Backend() string {
+	return p.backend
+}
 
-	return nil
+// Ready pings the database and checks whether the schema is at the expected version
+func (p *ManagerPersister) Ready(ctx context.Context) (int64, error) {
+	return checkReady(ctx, p.backend, p.db)
 }
 
 func (p *ManagerPersister) Close() error {
@@ -53,3 +49,14 @@ func (p *ManagerPersister) Close() error {
 
 	return nil
 }
+
+// Worker returns a worker persister which shares the manager persister's database connections,
+// so that both can be used in one process without opening a second pool
+func (p *ManagerPersister) Worker() *WorkerPersister {
+	return &WorkerPersister{
+		databaseURL: p.databaseURL,
+		backend:     p.backend,
+		queries:     p.queries,
+		db:          p.db,
+	}
+}
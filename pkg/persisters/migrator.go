@@ -0,0 +1,70 @@
+package persisters
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Migrator applies, rolls back and inspects the embedded migrations
+type Migrator struct {
+	databaseURL string
+	backend     string
+	db          *sql.DB
+}
+
+func NewMigrator(databaseURL string) *Migrator {
+	return &Migrator{
+		databaseURL: databaseURL,
+	}
+}
+
+func (m *Migrator) Open() error {
+	var err error
+	m.backend, m.db, _, err = openDatabase(m.databaseURL)
+
+	return err
+}
+
+// Backend returns the database backend, which is detected from the database URL when opening the migrator
+func (m *Migrator) Backend() string {
+	return m.backend
+}
+
+// Up applies all pending migrations
+func (m *Migrator) Up(ctx context.Context) error {
+	return migrateUp(ctx, m.backend, m.db)
+}
+
+// Down rolls back the latest applied migration
+func (m *Migrator) Down(ctx context.Context) error {
+	return migrateDown(ctx, m.backend, m.db)
+}
+
+// Status returns the status of all embedded migrations
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	return getMigrationStatus(ctx, m.backend, m.db)
+}
+
+// Version returns the schema version of the database and the version of the latest embedded migration
+func (m *Migrator) Version(ctx context.Context) (int64, int64, error) {
+	version, err := checkReady(ctx, m.backend, m.db)
+	if err != nil && !errors.Is(err, ErrSchemaOutdated) {
+		return -1, -1, err
+	}
+
+	expectedVersion, err := GetExpectedSchemaVersion(m.backend)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	return version, expectedVersion, nil
+}
+
+func (m *Migrator) Close() error {
+	if m.db != nil {
+		_ = m.db.Close()
+	}
+
+	return nil
+}
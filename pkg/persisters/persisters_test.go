@@ -0,0 +1,342 @@
+package persisters
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseDatabaseURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		databaseURL string
+		backend     string
+		dsn         string
+		err         error
+	}{
+		{
+			name:        "PostgreSQL",
+			databaseURL: "postgresql://postgres@localhost:5432/skysweeper?sslmode=disable",
+			backend:     BackendPostgres,
+			dsn:         "postgresql://postgres@localhost:5432/skysweeper?sslmode=disable",
+		},
+		{
+			name:        "PostgreSQL with short scheme",
+			databaseURL: "postgres://postgres@localhost:5432/skysweeper",
+			backend:     BackendPostgres,
+			dsn:         "postgres://postgres@localhost:5432/skysweeper",
+		},
+		{
+			name:        "SQLite with absolute path",
+			databaseURL: "sqlite:///var/lib/skysweeper/skysweeper.db",
+			backend:     BackendSQLite,
+			dsn:         "/var/lib/skysweeper/skysweeper.db?" + sqliteDefaultPragmas,
+		},
+		{
+			name:        "SQLite with relative path",
+			databaseURL: "sqlite3://skysweeper.db",
+			backend:     BackendSQLite,
+			dsn:         "skysweeper.db?" + sqliteDefaultPragmas,
+		},
+		{
+			name:        "SQLite with custom pragmas",
+			databaseURL: "sqlite://skysweeper.db?_pragma=busy_timeout(1000)",
+			backend:     BackendSQLite,
+			dsn:         "skysweeper.db?_pragma=busy_timeout(1000)",
+		},
+		{
+			name:        "SQLite without path",
+			databaseURL: "sqlite://",
+			err:         ErrUnsupportedDatabaseURL,
+		},
+		{
+			name:        "Unknown scheme",
+			databaseURL: "mysql://localhost/skysweeper",
+			err:         ErrUnsupportedDatabaseURL,
+		},
+		{
+			name:        "Missing scheme",
+			databaseURL: "skysweeper.db",
+			err:         ErrUnsupportedDatabaseURL,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, dsn, err := ParseDatabaseURL(tt.databaseURL)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			if backend != tt.backend || dsn != tt.dsn {
+				t.Fatalf("got backend %q and DSN %q, want %q and %q", backend, dsn, tt.backend, tt.dsn)
+			}
+		})
+	}
+}
+
+func TestSQLitePersisters(t *testing.T) {
+	ctx := context.Background()
+	databaseURL := "sqlite://" + filepath.Join(t.TempDir(), "skysweeper.db")
+
+	manager := NewManagerPersister(databaseURL)
+	if err := manager.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	if err := manager.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	worker := NewWorkerPersister(databaseURL)
+	if err := worker.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+
+	if _, err := worker.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := manager.UpsertConfiguration(ctx, "did:plc:alice", "https://bsky.social", "refreshjwt", true, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := worker.UpdateRefreshTokenAndCursor(ctx, "did:plc:alice", "3k00000000001", "rotatedjwt"); err != nil {
+		t.Fatal(err)
+	}
+
+	sweptAt := time.Now().Truncate(time.Second)
+	for _, points := range []int{5, 7} {
+		if err := worker.UpdateSweepStatistics(ctx, "did:plc:alice", points, true, 100, 20, sweptAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := worker.GetConfiguration(ctx, "did:plc:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.PointsSpent != 12 || !c.BacklogPending || c.PostsPending != 100 || c.LastSweptPosts != 20 || !c.LastSweptAt.Time.Equal(sweptAt) {
+		t.Fatalf("got configuration %+v, want 12 spent points, a pending backlog of 100 posts and the last sweep", c)
+	}
+
+	// Decreasing the post TTL resets the cursor
+	postTTL := int32(3)
+	c, err = manager.PatchConfiguration(ctx, "did:plc:alice", "https://bsky.social", "patchedjwt", nil, &postTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Enabled || c.PostTtl != 3 || c.Cursor != "" || c.RefreshJwt != "patchedjwt" {
+		t.Fatalf("got configuration %+v, want an enabled configuration with a post TTL of 3 and a reset cursor", c)
+	}
+
+	if err := worker.DisableConfiguration(ctx, "did:plc:alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	configurations, err := worker.GetEnabledConfigurations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(configurations) != 0 {
+		t.Fatalf("got %v enabled configurations, want none", len(configurations))
+	}
+
+	counts, err := manager.CountConfigurations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counts.Enabled != 0 || counts.DisabledByFailure != 1 {
+		t.Fatalf("got counts %+v, want 0 enabled and 1 disabled by failure", counts)
+	}
+}
+
+func TestSQLiteAdminPersister(t *testing.T) {
+	ctx := context.Background()
+	databaseURL := "sqlite://" + filepath.Join(t.TempDir(), "skysweeper.db")
+
+	manager := NewManagerPersister(databaseURL)
+	if err := manager.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	if err := manager.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := NewAdminPersister(databaseURL)
+	if err := admin.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	for _, did := range []string{"did:plc:bob", "did:plc:alice"} {
+		if _, err := manager.UpsertConfiguration(ctx, did, "https://bsky.social", "refreshjwt", true, 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := manager.Worker().UpdateRefreshTokenAndCursor(ctx, "did:plc:alice", "3k00000000001", "rotatedjwt"); err != nil {
+		t.Fatal(err)
+	}
+
+	configurations, err := admin.GetConfigurations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(configurations) != 2 || configurations[0].Did != "did:plc:alice" {
+		t.Fatalf("got configurations %+v, want both configurations ordered by DID", configurations)
+	}
+
+	page, err := admin.GetConfigurationsPage(ctx, "did:plc:alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page) != 1 || page[0].Did != "did:plc:bob" {
+		t.Fatalf("got page %+v, want only the configuration after alice", page)
+	}
+
+	c, err := admin.ResetConfigurationCursor(ctx, "did:plc:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Cursor != "" || c.RefreshJwt != "rotatedjwt" {
+		t.Fatalf("got configuration %+v, want a reset cursor and an unchanged refresh token", c)
+	}
+
+	if _, err := admin.SetConfigurationEnabled(ctx, "did:plc:bob", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := admin.SetConfigurationEnabled(ctx, "did:plc:carol", true); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("got error %v for missing configuration, want %v", err, sql.ErrNoRows)
+	}
+
+	counts, err := admin.CountConfigurations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counts.Total != 2 || counts.Enabled != 1 || counts.DisabledByFailure != 0 {
+		t.Fatalf("got counts %+v, want 2 in total, 1 enabled and none disabled by failure", counts)
+	}
+}
+
+func TestSQLiteMigrator(t *testing.T) {
+	ctx := context.Background()
+	databaseURL := "sqlite://" + filepath.Join(t.TempDir(), "skysweeper.db")
+
+	migrator := NewMigrator(databaseURL)
+	if err := migrator.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.Close()
+
+	// Inspecting a fresh database doesn't create the version table
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range statuses {
+		if status.Applied {
+			t.Fatalf("got status %+v for fresh database, want all migrations to be pending", status)
+		}
+	}
+
+	if exists, err := hasVersionTable(ctx, migrator.Backend(), migrator.db); err != nil || exists {
+		t.Fatalf("got version table %v and error %v after getting the status of a fresh database, want none", exists, err)
+	}
+
+	// Opening a persister doesn't migrate the database
+	worker := NewWorkerPersister(databaseURL)
+	if err := worker.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+
+	if _, err := worker.Ready(ctx); !errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("got error %v for fresh database, want %v", err, ErrSchemaOutdated)
+	}
+
+	version, expectedVersion, err := migrator.Version(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 0 || expectedVersion <= 0 {
+		t.Fatalf("got version %v and expected version %v, want 0 and the latest migration", version, expectedVersion)
+	}
+
+	if exists, err := hasVersionTable(ctx, migrator.Backend(), migrator.db); err != nil || exists {
+		t.Fatalf("got version table %v and error %v after checking the version of a fresh database, want none", exists, err)
+	}
+
+	// Readiness checks only read the version table, so they can run while migrating
+	done := make(chan struct{})
+	probed := make(chan struct{})
+	go func() {
+		defer close(probed)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, _ = worker.Ready(ctx)
+			}
+		}
+	}()
+
+	err = migrator.Up(ctx)
+	close(done)
+	<-probed
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err = migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range statuses {
+		if !status.Applied || status.AppliedAt == nil {
+			t.Fatalf("got status %+v after migrating up, want all migrations to be applied", status)
+		}
+	}
+
+	if _, err := worker.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrator.Down(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err = migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last := statuses[len(statuses)-1]; last.Applied || last.Version != expectedVersion {
+		t.Fatalf("got status %+v for latest migration after migrating down, want it to be pending", last)
+	}
+
+	if version, _, err := migrator.Version(ctx); err != nil || version != statuses[len(statuses)-2].Version {
+		t.Fatalf("got version %v and error %v after migrating down, want the previous migration", version, err)
+	}
+}
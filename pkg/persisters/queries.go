@@ -0,0 +1,202 @@
+package persisters
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pojntfx/skysweeper/pkg/models"
+	sqlitemodels "github.com/pojntfx/skysweeper/pkg/models/sqlite"
+)
+
+// Queries are the queries every database backend implements; they are generated by sqlc
+// from `pkg/queries` for PostgreSQL and from `pkg/queries/sqlite` for SQLite
+type Queries interface {
+	GetEnabledConfigurations(ctx context.Context) ([]models.Configuration, error)
+	GetConfiguration(ctx context.Context, did string) (models.Configuration, error)
+	DeleteConfiguration(ctx context.Context, did string) error
+	UpsertConfiguration(ctx context.Context, arg models.UpsertConfigurationParams) (models.Configuration, error)
+	UpdateConfigurationRefreshJWTAndCursor(ctx context.Context, arg models.UpdateConfigurationRefreshJWTAndCursorParams) error
+	DisableConfiguration(ctx context.Context, did string) error
+	UpdateConfigurationService(ctx context.Context, arg models.UpdateConfigurationServiceParams) error
+	PatchConfiguration(ctx context.Context, arg models.PatchConfigurationParams) (models.Configuration, error)
+	CountConfigurations(ctx context.Context) (models.CountConfigurationsRow, error)
+	GetConfigurations(ctx context.Context) ([]models.Configuration, error)
+	GetConfigurationsPage(ctx context.Context, arg models.GetConfigurationsPageParams) ([]models.Configuration, error)
+	SetConfigurationEnabled(ctx context.Context, arg models.SetConfigurationEnabledParams) (models.Configuration, error)
+	ResetConfigurationCursor(ctx context.Context, did string) (models.Configuration, error)
+	UpdateConfigurationSweepStatistics(ctx context.Context, arg models.UpdateConfigurationSweepStatisticsParams) error
+}
+
+// sqliteQueries converts between the SQLite and the PostgreSQL models, which only differ in their integer types
+type sqliteQueries struct {
+	queries *sqlitemodels.Queries
+}
+
+func fromSQLiteConfiguration(c sqlitemodels.Configuration) models.Configuration {
+	return models.Configuration{
+		Did:               c.Did,
+		Service:           c.Service,
+		RefreshJwt:        c.RefreshJwt,
+		Cursor:            c.Cursor,
+		Enabled:           c.Enabled,
+		PostTtl:           int32(c.PostTtl),
+		DisabledByFailure: c.DisabledByFailure,
+		PointsSpent:       c.PointsSpent,
+		BacklogPending:    c.BacklogPending,
+		LastSweptAt:       c.LastSweptAt,
+		PostsPending:      c.PostsPending,
+		LastSweptPosts:    c.LastSweptPosts,
+	}
+}
+
+func (q *sqliteQueries) GetEnabledConfigurations(ctx context.Context) ([]models.Configuration, error) {
+	rows, err := q.queries.GetEnabledConfigurations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	configurations := []models.Configuration{}
+	for _, row := range rows {
+		configurations = append(configurations, fromSQLiteConfiguration(row))
+	}
+
+	return configurations, nil
+}
+
+func (q *sqliteQueries) GetConfiguration(ctx context.Context, did string) (models.Configuration, error) {
+	c, err := q.queries.GetConfiguration(ctx, did)
+	if err != nil {
+		return models.Configuration{}, err
+	}
+
+	return fromSQLiteConfiguration(c), nil
+}
+
+func (q *sqliteQueries) DeleteConfiguration(ctx context.Context, did string) error {
+	return q.queries.DeleteConfiguration(ctx, did)
+}
+
+func (q *sqliteQueries) UpsertConfiguration(ctx context.Context, arg models.UpsertConfigurationParams) (models.Configuration, error) {
+	c, err := q.queries.UpsertConfiguration(ctx, sqlitemodels.UpsertConfigurationParams{
+		Did:        arg.Did,
+		Service:    arg.Service,
+		RefreshJwt: arg.RefreshJwt,
+		Enabled:    arg.Enabled,
+		PostTtl:    int64(arg.PostTtl),
+	})
+	if err != nil {
+		return models.Configuration{}, err
+	}
+
+	return fromSQLiteConfiguration(c), nil
+}
+
+func (q *sqliteQueries) UpdateConfigurationRefreshJWTAndCursor(ctx context.Context, arg models.UpdateConfigurationRefreshJWTAndCursorParams) error {
+	return q.queries.UpdateConfigurationRefreshJWTAndCursor(ctx, sqlitemodels.UpdateConfigurationRefreshJWTAndCursorParams{
+		RefreshJwt: arg.RefreshJwt,
+		Cursor:     arg.Cursor,
+		Did:        arg.Did,
+	})
+}
+
+func (q *sqliteQueries) DisableConfiguration(ctx context.Context, did string) error {
+	return q.queries.DisableConfiguration(ctx, did)
+}
+
+func (q *sqliteQueries) UpdateConfigurationService(ctx context.Context, arg models.UpdateConfigurationServiceParams) error {
+	return q.queries.UpdateConfigurationService(ctx, sqlitemodels.UpdateConfigurationServiceParams{
+		Service: arg.Service,
+		Did:     arg.Did,
+	})
+}
+
+func (q *sqliteQueries) PatchConfiguration(ctx context.Context, arg models.PatchConfigurationParams) (models.Configuration, error) {
+	c, err := q.queries.PatchConfiguration(ctx, sqlitemodels.PatchConfigurationParams{
+		Service:    arg.Service,
+		RefreshJwt: arg.RefreshJwt,
+		Enabled:    arg.Enabled,
+		PostTtl:    sql.NullInt64{Int64: int64(arg.PostTtl.Int32), Valid: arg.PostTtl.Valid},
+		Did:        arg.Did,
+	})
+	if err != nil {
+		return models.Configuration{}, err
+	}
+
+	return fromSQLiteConfiguration(c), nil
+}
+
+func (q *sqliteQueries) CountConfigurations(ctx context.Context) (models.CountConfigurationsRow, error) {
+	c, err := q.queries.CountConfigurations(ctx)
+	if err != nil {
+		return models.CountConfigurationsRow{}, err
+	}
+
+	return models.CountConfigurationsRow{
+		Enabled:           c.Enabled,
+		DisabledByFailure: c.DisabledByFailure,
+		Total:             c.Total,
+	}, nil
+}
+
+func (q *sqliteQueries) GetConfigurations(ctx context.Context) ([]models.Configuration, error) {
+	rows, err := q.queries.GetConfigurations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	configurations := []models.Configuration{}
+	for _, row := range rows {
+		configurations = append(configurations, fromSQLiteConfiguration(row))
+	}
+
+	return configurations, nil
+}
+
+func (q *sqliteQueries) GetConfigurationsPage(ctx context.Context, arg models.GetConfigurationsPageParams) ([]models.Configuration, error) {
+	rows, err := q.queries.GetConfigurationsPage(ctx, sqlitemodels.GetConfigurationsPageParams{
+		Did:   arg.Did,
+		Limit: int64(arg.Limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	configurations := []models.Configuration{}
+	for _, row := range rows {
+		configurations = append(configurations, fromSQLiteConfiguration(row))
+	}
+
+	return configurations, nil
+}
+
+func (q *sqliteQueries) SetConfigurationEnabled(ctx context.Context, arg models.SetConfigurationEnabledParams) (models.Configuration, error) {
+	c, err := q.queries.SetConfigurationEnabled(ctx, sqlitemodels.SetConfigurationEnabledParams{
+		Enabled: arg.Enabled,
+		Did:     arg.Did,
+	})
+	if err != nil {
+		return models.Configuration{}, err
+	}
+
+	return fromSQLiteConfiguration(c), nil
+}
+
+func (q *sqliteQueries) ResetConfigurationCursor(ctx context.Context, did string) (models.Configuration, error) {
+	c, err := q.queries.ResetConfigurationCursor(ctx, did)
+	if err != nil {
+		return models.Configuration{}, err
+	}
+
+	return fromSQLiteConfiguration(c), nil
+}
+
+func (q *sqliteQueries) UpdateConfigurationSweepStatistics(ctx context.Context, arg models.UpdateConfigurationSweepStatisticsParams) error {
+	return q.queries.UpdateConfigurationSweepStatistics(ctx, sqlitemodels.UpdateConfigurationSweepStatisticsParams{
+		PointsSpent:    arg.PointsSpent,
+		BacklogPending: arg.BacklogPending,
+		PostsPending:   arg.PostsPending,
+		LastSweptPosts: arg.LastSweptPosts,
+		LastSweptAt:    arg.LastSweptAt,
+		Did:            arg.Did,
+	})
+}
@@ -0,0 +1,262 @@
+package persisters
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/migrations"
+	sqlitemigrations "github.com/pojntfx/skysweeper/pkg/migrations/sqlite"
+	"github.com/pressly/goose/v3"
+)
+
+const (
+	// migrationLockID identifies the PostgreSQL advisory lock which serializes migrations across processes
+	migrationLockID = 0x736b7973776570
+)
+
+var (
+	ErrSchemaOutdated = errors.New("schema version does not match expected version")
+)
+
+// MigrationStatus is the status of an embedded migration in the database
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Source    string     `json:"source"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+// gooseLock serializes the use of goose, which is configured with package-level globals,
+// so that migrations of different databases in the same process can't change them for each other
+var gooseLock sync.Mutex
+
+func getMigrationsFS(backend string) fs.FS {
+	if backend == BackendSQLite {
+		return sqlitemigrations.FS
+	}
+
+	return migrations.FS
+}
+
+func setupGoose(backend string) error {
+	goose.SetBaseFS(getMigrationsFS(backend))
+
+	if backend == BackendSQLite {
+		return goose.SetDialect("sqlite3")
+	}
+
+	return goose.SetDialect("postgres")
+}
+
+// collectMigrations returns the embedded migrations of a backend from oldest to newest; unlike
+// `goose.CollectMigrations`, it doesn't depend on goose's globals, so it can be used without `gooseLock`
+func collectMigrations(backend string) ([]MigrationStatus, error) {
+	sources, err := fs.Glob(getMigrationsFS(backend), "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []MigrationStatus{}
+	for _, source := range sources {
+		version, err := goose.NumericComponent(source)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, MigrationStatus{
+			Version: version,
+			Source:  source,
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// GetExpectedSchemaVersion returns the version of the latest embedded migration for a backend
+func GetExpectedSchemaVersion(backend string) (int64, error) {
+	migrations, err := collectMigrations(backend)
+	if err != nil {
+		return -1, err
+	}
+
+	if len(migrations) == 0 {
+		return -1, goose.ErrNoMigrationFiles
+	}
+
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// getSchemaVersion returns the latest applied migration like `goose.GetDBVersion`, but only reads
+// the version table and returns 0 if it doesn't exist yet instead of creating it
+func getSchemaVersion(ctx context.Context, backend string, db *sql.DB) (int64, error) {
+	applied, err := getAppliedMigrations(ctx, backend, db)
+	if err != nil {
+		return -1, err
+	}
+
+	var version int64
+	for _, status := range applied {
+		if status.Applied && status.Version > version {
+			version = status.Version
+		}
+	}
+
+	return version, nil
+}
+
+func checkReady(ctx context.Context, backend string, db *sql.DB) (int64, error) {
+	if err := db.PingContext(ctx); err != nil {
+		return -1, err
+	}
+
+	version, err := getSchemaVersion(ctx, backend, db)
+	if err != nil {
+		return -1, err
+	}
+
+	expectedVersion, err := GetExpectedSchemaVersion(backend)
+	if err != nil {
+		return -1, err
+	}
+
+	if version != expectedVersion {
+		return version, fmt.Errorf("%w: got %v, expected %v", ErrSchemaOutdated, version, expectedVersion)
+	}
+
+	return version, nil
+}
+
+// withMigrationLock runs fn while holding a lock which prevents other processes from migrating
+// the database at the same time; SQLite already serializes writers, so it is only taken for PostgreSQL
+func withMigrationLock(ctx context.Context, backend string, db *sql.DB, fn func() error) error {
+	if backend == BackendSQLite {
+		return fn()
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "select pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "select pg_advisory_unlock($1)", migrationLockID)
+
+	return fn()
+}
+
+func migrateUp(ctx context.Context, backend string, db *sql.DB) error {
+	gooseLock.Lock()
+	defer gooseLock.Unlock()
+
+	if err := setupGoose(backend); err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, backend, db, func() error {
+		return goose.UpContext(ctx, db, ".")
+	})
+}
+
+func migrateDown(ctx context.Context, backend string, db *sql.DB) error {
+	gooseLock.Lock()
+	defer gooseLock.Unlock()
+
+	if err := setupGoose(backend); err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, backend, db, func() error {
+		return goose.DownContext(ctx, db, ".")
+	})
+}
+
+func getMigrationStatus(ctx context.Context, backend string, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := collectMigrations(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := getAppliedMigrations(ctx, backend, db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, status := range migrations {
+		if a, ok := applied[status.Version]; ok && a.Applied {
+			status.Applied = true
+			status.AppliedAt = a.AppliedAt
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// getAppliedMigrations returns the latest status of every migration in the version table; unlike goose,
+// it doesn't create the version table if the database is empty, so inspecting the schema never writes to it
+func getAppliedMigrations(ctx context.Context, backend string, db *sql.DB) (map[int64]MigrationStatus, error) {
+	applied := map[int64]MigrationStatus{}
+
+	exists, err := hasVersionTable(ctx, backend, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := db.QueryContext(ctx, "select version_id, is_applied, tstamp from "+goose.TableName()+" order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Later rows override earlier ones, since rolling back a migration adds a row instead of deleting one
+	for rows.Next() {
+		var (
+			status    MigrationStatus
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&status.Version, &status.Applied, &appliedAt); err != nil {
+			return nil, err
+		}
+		status.AppliedAt = &appliedAt
+
+		applied[status.Version] = status
+	}
+
+	return applied, rows.Err()
+}
+
+func hasVersionTable(ctx context.Context, backend string, db *sql.DB) (bool, error) {
+	var exists bool
+	if backend == BackendSQLite {
+		if err := db.QueryRowContext(ctx, "select exists (select 1 from sqlite_master where type = 'table' and name = ?)", goose.TableName()).Scan(&exists); err != nil {
+			return false, err
+		}
+
+		return exists, nil
+	}
+
+	if err := db.QueryRowContext(ctx, "select to_regclass($1) is not null", goose.TableName()).Scan(&exists); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
@@ -1,35 +1,53 @@
 package persisters
 
 import (
+	"context"
 	"database/sql"
-
-	"github.com/pojntfx/skysweeper/pkg/models"
-
-	_ "github.com/lib/pq"
 )
 
 type WorkerPersister struct {
-	pgaddr  string
-	queries *models.Queries
-	db      *sql.DB
+	databaseURL string
+	backend     string
+	queries     Queries
+	db          *sql.DB
 }
 
-func NewWorkerPersister(pgaddr string) *WorkerPersister {
+func NewWorkerPersister(databaseURL string) *WorkerPersister {
 	return &WorkerPersister{
-		pgaddr: pgaddr,
+		databaseURL: databaseURL,
 	}
 }
 
 func (p *WorkerPersister) Open() error {
 	var err error
-	p.db, err = sql.Open("postgres", p.pgaddr)
-	if err != nil {
-		return err
-	}
+	p.backend, p.db, p.queries, err = openDatabase(p.databaseURL)
 
-	p.queries = models.New(p.db)
+	return err
+}
 
-	return nil
+// Migrate applies all pending migrations
+func (p *WorkerPersister) Migrate(ctx context.Context) error {
+	return migrateUp(ctx, p.backend, p.db)
+}
+
+// Backend returns the database backend, which is detected from the database URL when opening the persister
+func (p *WorkerPersister) Backend() string {
+	return p.backend
+}
+
+// Ready pings the database and checks whether the schema is at the expected version
+func (p *WorkerPersister) Ready(ctx context.Context) (int64, error) {
+	return checkReady(ctx, p.backend, p.db)
+}
+
+// Admin returns an admin persister which shares the worker persister's database connections
+func (p *WorkerPersister) Admin() *AdminPersister {
+	return &AdminPersister{
+		databaseURL: p.databaseURL,
+		backend:     p.backend,
+		queries:     p.queries,
+		db:          p.db,
+	}
 }
 
 func (p *WorkerPersister) Close() error {
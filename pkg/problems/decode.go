@@ -0,0 +1,64 @@
+package problems
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrCouldNotDecode    = errors.New("could not decode")
+	ErrBodyTooLarge      = errors.New("body too large")
+	ErrInvalidFields     = errors.New("invalid fields")
+	errUnexpectedContent = errors.New("unexpected content after JSON body")
+)
+
+const unknownFieldPrefix = "json: unknown field "
+
+// DecodeJSON strictly decodes a request body of at most maxBodySize bytes into v,
+// rejecting unknown fields and trailing content
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v any, maxBodySize int64) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		var (
+			maxBytesErr      *http.MaxBytesError
+			unmarshalTypeErr *json.UnmarshalTypeError
+		)
+		switch {
+		case errors.As(err, &maxBytesErr):
+			return New(http.StatusRequestEntityTooLarge, fmt.Errorf("%w: must be at most %v bytes", ErrBodyTooLarge, maxBytesErr.Limit), nil)
+
+		case errors.As(err, &unmarshalTypeErr):
+			return Invalid(ErrInvalidFields, []FieldError{
+				{
+					Pointer: "#/" + strings.ReplaceAll(unmarshalTypeErr.Field, ".", "/"),
+					Detail:  fmt.Sprintf("must be of type %v", unmarshalTypeErr.Type),
+				},
+			})
+
+		case strings.HasPrefix(err.Error(), unknownFieldPrefix):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), unknownFieldPrefix), `"`)
+
+			return Invalid(ErrInvalidFields, []FieldError{
+				{
+					Pointer: "#/" + field,
+					Detail:  "unknown field",
+				},
+			})
+
+		default:
+			return BadRequest(fmt.Errorf("%w: %v", ErrCouldNotDecode, err))
+		}
+	}
+
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return BadRequest(fmt.Errorf("%w: %v", ErrCouldNotDecode, errUnexpectedContent))
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package problems
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/logging"
+)
+
+const (
+	ContentType = "application/problem+json"
+
+	typeDefault = "about:blank"
+)
+
+var (
+	errInternal = errors.New("internal server error")
+)
+
+// Problem is a JSON problem document (see RFC 9457)
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Errors []FieldError `json:"errors,omitempty"`
+
+	err error
+}
+
+// FieldError describes why a single field of a request body is invalid
+type FieldError struct {
+	Pointer string `json:"pointer"` // JSON pointer to the field (see RFC 6901)
+	Detail  string `json:"detail"`
+}
+
+// New creates a problem with a detail that is safe to show to clients and
+// an optional cause which is only logged
+func New(status int, detail error, cause error) *Problem {
+	err := detail
+	if cause != nil {
+		err = fmt.Errorf("%w: %v", detail, cause)
+	}
+
+	return &Problem{
+		Type:   typeDefault,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail.Error(),
+
+		err: err,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.err == nil {
+		return p.Title
+	}
+
+	return p.err.Error()
+}
+
+func (p *Problem) Unwrap() error {
+	return p.err
+}
+
+func BadRequest(detail error) *Problem {
+	return New(http.StatusBadRequest, detail, nil)
+}
+
+func Unauthorized(detail error) *Problem {
+	return New(http.StatusUnauthorized, detail, nil)
+}
+
+func NotFound(detail error) *Problem {
+	return New(http.StatusNotFound, detail, nil)
+}
+
+func MethodNotAllowed(method string) *Problem {
+	return New(http.StatusMethodNotAllowed, fmt.Errorf("method %v is not allowed", method), nil)
+}
+
+func UnprocessableEntity(detail error) *Problem {
+	return New(http.StatusUnprocessableEntity, detail, nil)
+}
+
+func Invalid(detail error, fieldErrors []FieldError) *Problem {
+	p := New(http.StatusUnprocessableEntity, detail, nil)
+	p.Errors = fieldErrors
+
+	return p
+}
+
+// Database maps an error returned by a persister to either a 503 if the database
+// can't be reached or a 500 otherwise
+func Database(detail error, cause error) *Problem {
+	if IsUnavailable(cause) {
+		return New(http.StatusServiceUnavailable, detail, cause)
+	}
+
+	return New(http.StatusInternalServerError, detail, cause)
+}
+
+// Session maps an error returned by a PDS while getting or refreshing a session to
+// either a 401 if the PDS rejected the token or a 502 otherwise
+func Session(detail error, cause error) *Problem {
+	var xe *xrpc.XRPCError
+	if errors.As(cause, &xe) {
+		switch xe.ErrStr {
+		case "ExpiredToken", "InvalidToken", "AuthenticationRequired", "AuthMissing", "AccountTakedown":
+			return New(http.StatusUnauthorized, detail, cause)
+		}
+	}
+
+	return New(http.StatusBadGateway, detail, cause)
+}
+
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// FromError returns the problem wrapped in an error or an opaque 500 if there is none
+func FromError(err error) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		return p
+	}
+
+	return New(http.StatusInternalServerError, errInternal, err)
+}
+
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	p := *FromError(err)
+	p.Instance = r.URL.Path
+
+	logger := logging.FromContext(r.Context()).With("path", r.URL.Path, "method", r.Method, "status", p.Status)
+	if p.Status >= http.StatusInternalServerError {
+		logger.Error("Could not handle request", "err", err)
+	} else {
+		logger.Debug("Could not handle request", "err", err)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		logger.Error("Could not encode problem", "err", err)
+	}
+}
+
+// HandlerFunc is a HTTP handler which can return an error that gets written as a problem
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		Write(w, r, err)
+	}
+}
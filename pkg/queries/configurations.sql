@@ -24,7 +24,8 @@ set service = excluded.service,
     refresh_jwt = excluded.refresh_jwt,
     cursor = '',
     enabled = excluded.enabled,
-    post_ttl = excluded.post_ttl
+    post_ttl = excluded.post_ttl,
+    disabled_by_failure = false
 returning *;
 -- name: UpdateConfigurationRefreshJWTAndCursor :exec
 update configurations
@@ -33,5 +34,61 @@ set refresh_jwt = $1,
 where did = $3;
 -- name: DisableConfiguration :exec
 update configurations
-set enabled = false
-where did = $1;
\ No newline at end of file
+set enabled = false,
+    disabled_by_failure = true
+where did = $1;
+-- name: UpdateConfigurationService :exec
+update configurations
+set service = $1
+where did = $2;
+-- name: PatchConfiguration :one
+update configurations
+set service = sqlc.arg(service),
+    refresh_jwt = sqlc.arg(refresh_jwt),
+    enabled = coalesce(sqlc.narg(enabled), enabled),
+    post_ttl = coalesce(sqlc.narg(post_ttl), post_ttl),
+    cursor = case
+        when sqlc.narg(post_ttl) < post_ttl then ''
+        else cursor
+    end,
+    disabled_by_failure = false
+where did = sqlc.arg(did)
+returning *;
+-- name: CountConfigurations :one
+select count(*) filter (
+        where enabled
+    ) as enabled,
+    count(*) filter (
+        where disabled_by_failure
+    ) as disabled_by_failure,
+    count(*) as total
+from configurations;
+-- name: GetConfigurations :many
+select *
+from configurations
+order by did;
+-- name: GetConfigurationsPage :many
+select *
+from configurations
+where did > $1
+order by did
+limit $2;
+-- name: SetConfigurationEnabled :one
+update configurations
+set enabled = $1,
+    disabled_by_failure = false
+where did = $2
+returning *;
+-- name: ResetConfigurationCursor :one
+update configurations
+set cursor = ''
+where did = $1
+returning *;
+-- name: UpdateConfigurationSweepStatistics :exec
+update configurations
+set points_spent = points_spent + $1,
+    backlog_pending = $2,
+    posts_pending = $3,
+    last_swept_posts = $4,
+    last_swept_at = $5
+where did = $6;
\ No newline at end of file
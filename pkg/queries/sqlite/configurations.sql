@@ -0,0 +1,90 @@
+-- name: GetEnabledConfigurations :many
+select *
+from configurations
+where enabled = true;
+-- name: GetConfiguration :one
+select *
+from configurations
+where did = ?;
+-- name: DeleteConfiguration :exec
+delete from configurations
+where did = ?;
+-- name: UpsertConfiguration :one
+insert into configurations (
+        did,
+        service,
+        refresh_jwt,
+        cursor,
+        enabled,
+        post_ttl
+    )
+values (?, ?, ?, '', ?, ?) on conflict (did) do
+update
+set service = excluded.service,
+    refresh_jwt = excluded.refresh_jwt,
+    cursor = '',
+    enabled = excluded.enabled,
+    post_ttl = excluded.post_ttl,
+    disabled_by_failure = false
+returning *;
+-- name: UpdateConfigurationRefreshJWTAndCursor :exec
+update configurations
+set refresh_jwt = ?,
+    cursor = ?
+where did = ?;
+-- name: DisableConfiguration :exec
+update configurations
+set enabled = false,
+    disabled_by_failure = true
+where did = ?;
+-- name: UpdateConfigurationService :exec
+update configurations
+set service = ?
+where did = ?;
+-- name: PatchConfiguration :one
+update configurations
+set service = sqlc.arg(service),
+    refresh_jwt = sqlc.arg(refresh_jwt),
+    enabled = coalesce(sqlc.narg(enabled), enabled),
+    post_ttl = coalesce(sqlc.narg(post_ttl), post_ttl),
+    cursor = case
+        when sqlc.narg(post_ttl) < post_ttl then ''
+        else cursor
+    end,
+    disabled_by_failure = false
+where did = sqlc.arg(did)
+returning *;
+-- name: CountConfigurations :one
+select cast(coalesce(sum(enabled), 0) as integer) as enabled,
+    cast(coalesce(sum(disabled_by_failure), 0) as integer) as disabled_by_failure,
+    count(*) as total
+from configurations;
+-- name: GetConfigurations :many
+select *
+from configurations
+order by did;
+-- name: GetConfigurationsPage :many
+select *
+from configurations
+where did > ?
+order by did
+limit ?;
+-- name: SetConfigurationEnabled :one
+update configurations
+set enabled = ?,
+    disabled_by_failure = false
+where did = ?
+returning *;
+-- name: ResetConfigurationCursor :one
+update configurations
+set cursor = ''
+where did = ?
+returning *;
+-- name: UpdateConfigurationSweepStatistics :exec
+update configurations
+set points_spent = points_spent + ?,
+    backlog_pending = ?,
+    posts_pending = ?,
+    last_swept_posts = ?,
+    last_swept_at = ?
+where did = ?;
\ No newline at end of file
@@ -0,0 +1,43 @@
+package sweeper
+
+import (
+	"math"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/bluesky"
+)
+
+// backlog tracks the expired posts listed in a sweep of a DID to estimate how many are left after it
+type backlog struct {
+	listed int
+
+	first time.Time
+	last  time.Time
+}
+
+func (b *backlog) add(posts []bluesky.Record) {
+	if len(posts) == 0 {
+		return
+	}
+
+	if b.listed == 0 {
+		b.first = posts[0].CreatedAt
+	}
+
+	b.listed += len(posts)
+	b.last = posts[len(posts)-1].CreatedAt
+}
+
+// estimate returns the listed posts which haven't been deleted plus the posts which are expected between the last
+// listed post and cutoff; since posts are listed from oldest to newest, the rate at which they have been created
+// between the first and the last listed post is extrapolated up to cutoff
+func (b *backlog) estimate(deleted int, cutoff time.Time) int {
+	pending := max(b.listed-deleted, 0)
+
+	listedSpan, restSpan := b.last.Sub(b.first), cutoff.Sub(b.last)
+	if b.listed < 2 || listedSpan <= 0 || restSpan <= 0 {
+		return pending
+	}
+
+	return pending + int(math.Round(float64(b.listed-1)*restSpan.Seconds()/listedSpan.Seconds()))
+}
@@ -0,0 +1,31 @@
+package sweeper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pojntfx/skysweeper/pkg/bluesky"
+)
+
+func TestBacklogExtrapolatesListedPostsUpToCutoff(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// One post per day for ten days, of which the last two haven't been deleted
+	b := &backlog{}
+	for page := 0; page < 2; page++ {
+		posts := []bluesky.Record{}
+		for day := page * 5; day < (page+1)*5; day++ {
+			posts = append(posts, bluesky.Record{CreatedAt: start.AddDate(0, 0, day)})
+		}
+
+		b.add(posts)
+	}
+
+	if got := b.estimate(8, start.AddDate(0, 0, 29)); got != 22 {
+		t.Fatalf("got estimate %v, want 2 undeleted posts and 20 more posts until the cutoff", got)
+	}
+
+	if got := (&backlog{}).estimate(0, start); got != 0 {
+		t.Fatalf("got estimate %v without listed posts, want 0", got)
+	}
+}
@@ -0,0 +1,104 @@
+package sweeper
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/bluesky"
+)
+
+// PDSClient sweeps accounts using the API of their PDS
+type PDSClient struct {
+	httpClient      *http.Client
+	plcDirectoryURL string
+	servicePolicy   *bluesky.ServicePolicy
+}
+
+// NewPDSClient creates a client which only sweeps services allowed by servicePolicy (if nil, all services
+// are allowed); httpClient should be created by the same policy, since DID documents are controlled by users
+func NewPDSClient(httpClient *http.Client, plcDirectoryURL string, servicePolicy *bluesky.ServicePolicy) *PDSClient {
+	return &PDSClient{
+		httpClient:      httpClient,
+		plcDirectoryURL: plcDirectoryURL,
+		servicePolicy:   servicePolicy,
+	}
+}
+
+func (c *PDSClient) ResolvePDS(ctx context.Context, did string) (string, error) {
+	return bluesky.ResolvePDS(ctx, c.httpClient, c.plcDirectoryURL, did)
+}
+
+func (c *PDSClient) ValidateService(ctx context.Context, service string) error {
+	if c.servicePolicy == nil {
+		return nil
+	}
+
+	return c.servicePolicy.Validate(ctx, service)
+}
+
+func (c *PDSClient) RefreshSession(ctx context.Context, service string, refreshJWT string) (*xrpc.AuthInfo, error) {
+	session, err := atproto.ServerRefreshSession(ctx, &xrpc.Client{
+		Client: c.httpClient,
+		Host:   service,
+		Auth: &xrpc.AuthInfo{
+			AccessJwt: refreshJWT,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &xrpc.AuthInfo{
+		AccessJwt:  session.AccessJwt,
+		RefreshJwt: session.RefreshJwt,
+		Handle:     session.Handle,
+		Did:        session.Did,
+	}, nil
+}
+
+func (c *PDSClient) SweepPosts(
+	ctx context.Context,
+
+	service string,
+	auth *xrpc.AuthInfo,
+
+	postTTL int,
+	cursor string,
+	listBatchSize int,
+	limit int,
+	deleteBatchSize int,
+
+	dryRun bool,
+
+	limiter bluesky.Spender,
+
+	onPageListed func(posts []bluesky.Record),
+	onBatchDeleted func(batch []bluesky.Record),
+	commit func(cursor string) error,
+) (int, error) {
+	return bluesky.SweepPosts(
+		ctx,
+
+		&xrpc.Client{
+			Client: c.httpClient,
+			Host:   service,
+			Auth:   auth,
+		},
+
+		postTTL,
+		cursor,
+		listBatchSize,
+		limit,
+		deleteBatchSize,
+
+		dryRun,
+
+		limiter,
+
+		onPageListed,
+		onBatchDeleted,
+		commit,
+	)
+}
@@ -0,0 +1,507 @@
+package sweeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/bluesky"
+	"github.com/pojntfx/skysweeper/pkg/logging"
+	"github.com/pojntfx/skysweeper/pkg/metrics"
+	"github.com/pojntfx/skysweeper/pkg/models"
+	"github.com/pojntfx/skysweeper/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	minPointsDID = bluesky.PointsGet + bluesky.PointsDelete // Enough to list a page and delete from it, so that every swept DID makes progress
+)
+
+var (
+	ErrCouldNotGetConfigurations = errors.New("could not get configurations")
+	ErrDeferred                  = errors.New("deferred to the next sweep since the budget of this sweep has been spent")
+
+	errCouldNotUpdateService  = errors.New("could not update service")
+	errServiceNotAllowed      = errors.New("service not allowed")
+	errCouldNotRefreshSession = errors.New("could not refresh session")
+	errCouldNotSaveProgress   = errors.New("could not save refresh token and cursor")
+)
+
+// Persister stores the configurations to sweep and their progress
+type Persister interface {
+	GetConfiguration(ctx context.Context, did string) (models.Configuration, error)
+	GetEnabledConfigurations(ctx context.Context) ([]models.Configuration, error)
+	DisableConfiguration(ctx context.Context, did string) error
+	UpdateRefreshTokenAndCursor(ctx context.Context, did string, cursor string, refreshJWT string) error
+	UpdateService(ctx context.Context, did string, service string) error
+
+	// UpdateSweepStatistics adds the points spent on did to its total and records whether it has a backlog left,
+	// how many posts it is estimated to contain and how many posts have been deleted in the sweep
+	UpdateSweepStatistics(ctx context.Context, did string, pointsSpent int, backlogPending bool, postsPending int, sweptPosts int, sweptAt time.Time) error
+}
+
+// Client talks to the PDS of the accounts to sweep
+type Client interface {
+	ResolvePDS(ctx context.Context, did string) (string, error)
+
+	// ValidateService returns an error if service must not be sent refresh tokens, e.g. since it is private
+	ValidateService(ctx context.Context, service string) error
+
+	// RefreshSession exchanges a refresh token for a new session, which rotates the refresh token
+	RefreshSession(ctx context.Context, service string, refreshJWT string) (*xrpc.AuthInfo, error)
+
+	// SweepPosts deletes expired posts page by page (see `bluesky.SweepPosts`)
+	SweepPosts(
+		ctx context.Context,
+
+		service string,
+		auth *xrpc.AuthInfo,
+
+		postTTL int,
+		cursor string,
+		listBatchSize int,
+		limit int,
+		deleteBatchSize int,
+
+		dryRun bool,
+
+		limiter bluesky.Spender,
+
+		onPageListed func(posts []bluesky.Record),
+		onBatchDeleted func(batch []bluesky.Record),
+		commit func(cursor string) error,
+	) (int, error)
+}
+
+type Options struct {
+	RateLimitPointsGlobal  int           // Maximum amount of rate limit points to spend per reset interval
+	RateLimitResetInterval time.Duration // Duration of a rate limit reset interval
+	RateLimitPointsDID     int           // Maximum amount of rate limit points to spend per DID and sweep, both for listing and deleting (at least enough to delete one post)
+	RateLimitPointsSweep   int           // Maximum amount of rate limit points to spend per sweep, which are shared fairly between DIDs (if zero, unlimited)
+	ListRecordsLimit       int           // Records to list per page
+	ApplyWritesLimit       int           // Records to delete per batch
+
+	DryRun bool // Only list posts to delete without deleting them
+}
+
+// Progress is the progress of a DID at the time a hook is called
+type Progress struct {
+	PostsDeleted int // Posts of the DID deleted so far
+	PostsTotal   int // Expired posts of the DID listed so far
+	SpentPoints  int // Rate limit points spent by the whole sweep so far
+}
+
+// Hooks are called while sweeping; all of them are optional
+type Hooks struct {
+	OnStarted      func(dids int)
+	OnThrottled    func()
+	OnDIDStarted   func(did string)
+	OnPostsListed  func(did string, posts int, progress Progress)
+	OnBatchDeleted func(did string, posts int, progress Progress)
+	OnDIDFinished  func(did string, progress Progress, err error)
+}
+
+type Result struct {
+	DIDs         int
+	DIDsFailed   int
+	DIDsDeferred int // DIDs which haven't been swept since the budget of the sweep has been spent
+	DIDsPending  int // DIDs which have spent their budget before all of their expired posts have been deleted
+	PostsListed  int
+	PostsDeleted int
+	SpentPoints  int
+	Throttled    int
+	Duration     time.Duration
+}
+
+// Sweeper deletes expired posts of the configurations in a persister
+type Sweeper struct {
+	persister Persister
+	client    Client
+
+	options Options
+}
+
+func NewSweeper(persister Persister, client Client, options Options) *Sweeper {
+	return &Sweeper{
+		persister: persister,
+		client:    client,
+
+		options: options,
+	}
+}
+
+// getConfigurations returns all enabled configurations, or only the configuration of did if it is set and enabled
+func (s *Sweeper) getConfigurations(ctx context.Context, did string) ([]models.Configuration, error) {
+	if did == "" {
+		return s.persister.GetEnabledConfigurations(ctx)
+	}
+
+	configuration, err := s.persister.GetConfiguration(ctx, did)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return []models.Configuration{}, nil
+		}
+
+		return nil, err
+	}
+
+	if !configuration.Enabled {
+		return []models.Configuration{}, nil
+	}
+
+	return []models.Configuration{configuration}, nil
+}
+
+// Sweep deletes expired posts of all enabled configurations, or only of the configuration of did if it is set.
+// A DID which can't be swept is skipped after saving its progress; cancelling ctx stops the sweep between batches.
+func (s *Sweeper) Sweep(ctx context.Context, did string, hooks Hooks) (Result, error) {
+	logger := logging.FromContext(ctx)
+
+	result := Result{}
+
+	limiterCtx, cancelLimiter := context.WithCancel(ctx)
+	defer cancelLimiter()
+
+	limiter := bluesky.NewLimiter(
+		limiterCtx,
+
+		s.options.RateLimitPointsGlobal,
+		s.options.RateLimitResetInterval,
+
+		func() error {
+			logger.Info("Pausing until rate limit reset interval")
+
+			result.Throttled++
+			metrics.ThrottleWaits.Inc()
+
+			if hooks.OnThrottled != nil {
+				hooks.OnThrottled()
+			}
+
+			return nil
+		},
+	)
+
+	go limiter.Open()
+
+	before := time.Now()
+
+	ctx, sweepSpan := tracing.Tracer().Start(ctx, "Sweeper.sweep", trace.WithAttributes(
+		attribute.Bool("dryRun", s.options.DryRun),
+	))
+	defer sweepSpan.End()
+
+	configurations, err := s.getConfigurations(ctx, did)
+	if err != nil {
+		tracing.SetError(sweepSpan, err)
+
+		return result, fmt.Errorf("%w: %v", ErrCouldNotGetConfigurations, err)
+	}
+
+	result.DIDs = len(configurations)
+
+	sweepSpan.SetAttributes(attribute.Int("configurations", len(configurations)))
+
+	if hooks.OnStarted != nil {
+		hooks.OnStarted(len(configurations))
+	}
+
+	logger.Info("Starting sweep", "configurations", len(configurations), "dry_run", s.options.DryRun)
+
+	prioritize(configurations)
+
+	for i, configuration := range configurations {
+		if ctx.Err() != nil {
+			logger.Info("Stopping sweep before next DID since it has been cancelled")
+
+			break
+		}
+
+		points := max(s.options.RateLimitPointsDID, minPointsDID)
+		if s.options.RateLimitPointsSweep > 0 {
+			// Split the rest of the sweep's budget evenly between the remaining DIDs so that accounts with large backlogs
+			// can't starve the ones after them; points which a DID doesn't need carry over to the next ones, and if
+			// fewer points than DIDs are left, the DIDs with the highest priority get them while the rest is deferred
+			remaining := s.options.RateLimitPointsSweep - limiter.GetSpendPoints()
+
+			points = min(points, max(remaining/(len(configurations)-i), min(remaining, minPointsDID)))
+		}
+
+		listed, deleted, pending, err := s.sweepDID(ctx, configuration, limiter, points, hooks)
+
+		result.PostsListed += listed
+		result.PostsDeleted += deleted
+
+		if pending {
+			result.DIDsPending++
+		}
+
+		if errors.Is(err, ErrDeferred) {
+			result.DIDsDeferred++
+		} else if err != nil {
+			result.DIDsFailed++
+		}
+	}
+
+	result.SpentPoints = limiter.GetSpendPoints()
+	result.Duration = time.Since(before)
+
+	sweepSpan.SetAttributes(
+		attribute.Int("spentPoints", result.SpentPoints),
+		attribute.Int("throttled", result.Throttled),
+		attribute.Int("postsDeleted", result.PostsDeleted),
+	)
+
+	metrics.LimiterPointsSpent.Add(float64(result.SpentPoints))
+	metrics.SweepDuration.Observe(result.Duration.Seconds())
+
+	logger.Info(
+		"Finished sweep",
+		"spent_points", result.SpentPoints,
+		"spent_time", result.Duration.String(),
+		"throttled", result.Throttled,
+		"posts_deleted", result.PostsDeleted,
+		"dids_failed", result.DIDsFailed,
+		"dids_deferred", result.DIDsDeferred,
+		"dids_pending", result.DIDsPending,
+		"dry_run", s.options.DryRun,
+	)
+
+	return result, ctx.Err()
+}
+
+// prioritize sorts configurations whose backlog hasn't been deleted in their last sweep first, starting with
+// the largest estimated backlog, followed by the ones which have waited the longest since their last sweep
+func prioritize(configurations []models.Configuration) {
+	sort.SliceStable(configurations, func(i, j int) bool {
+		a, b := configurations[i], configurations[j]
+
+		if a.BacklogPending != b.BacklogPending {
+			return a.BacklogPending
+		}
+
+		if a.BacklogPending && a.PostsPending != b.PostsPending {
+			return a.PostsPending > b.PostsPending
+		}
+
+		if a.LastSweptAt.Valid != b.LastSweptAt.Valid {
+			return !a.LastSweptAt.Valid
+		}
+
+		return a.LastSweptAt.Time.Before(b.LastSweptAt.Time)
+	})
+}
+
+// sweepDID deletes the expired posts of a single configuration while spending at most points and returns how many
+// expired posts have been listed and deleted and whether some are left; the rotated refresh token and the cursor
+// are saved even if it fails
+func (s *Sweeper) sweepDID(
+	ctx context.Context,
+
+	configuration models.Configuration,
+
+	limiter *bluesky.Limiter,
+	points int,
+	hooks Hooks,
+) (listed int, deleted int, pending bool, err error) {
+	progress := Progress{}
+
+	if hooks.OnDIDStarted != nil {
+		hooks.OnDIDStarted(configuration.Did)
+	}
+	defer func() {
+		progress.SpentPoints = limiter.GetSpendPoints()
+
+		if hooks.OnDIDFinished != nil {
+			hooks.OnDIDFinished(configuration.Did, progress, err)
+		}
+	}()
+
+	ctx, didSpan := tracing.Tracer().Start(ctx, "Sweeper.sweepDID", trace.WithAttributes(
+		attribute.String("did", configuration.Did),
+	))
+	defer func() {
+		tracing.EndSpan(didSpan, err)
+	}()
+
+	ctx, logger := logging.With(ctx, "did", configuration.Did)
+
+	if points < minPointsDID {
+		logger.Info("Not enough points left in this sweep, deferring DID to the next one")
+
+		return 0, 0, false, ErrDeferred
+	}
+
+	resolveCtx, resolveSpan := tracing.Tracer().Start(ctx, "Sweeper.resolvePDS")
+	service, err := s.client.ResolvePDS(resolveCtx, configuration.Did)
+	if err == nil && !bluesky.ServicesEqual(service, configuration.Service) {
+		// The DID document is controlled by the user, so the PDS it points to must be validated before it gets the refresh token
+		err = s.client.ValidateService(resolveCtx, service)
+	}
+	tracing.EndSpan(resolveSpan, err)
+	if err != nil {
+		logger.Warn("Could not resolve PDS, continuing with stored service", "service", configuration.Service, "err", err)
+	} else if !bluesky.ServicesEqual(service, configuration.Service) {
+		logger.Info("PDS has moved, updating service", "from", configuration.Service, "to", service)
+
+		if err := s.persister.UpdateService(ctx, configuration.Did, service); err != nil {
+			logger.Error("Could not update service, skipping", "err", err)
+
+			return 0, 0, false, fmt.Errorf("%w: %v", errCouldNotUpdateService, err)
+		}
+
+		configuration.Service = service
+	}
+
+	didSpan.SetAttributes(attribute.String("service", configuration.Service))
+
+	ctx, logger = logging.With(ctx, "service", configuration.Service)
+
+	// The allowlist, denylist or resolved addresses might have changed since the service has been stored
+	if err := s.client.ValidateService(ctx, configuration.Service); err != nil {
+		logger.Warn("Service is not allowed, skipping", "err", err)
+
+		return 0, 0, false, fmt.Errorf("%w: %v", errServiceNotAllowed, err)
+	}
+
+	// Refreshing rotates the refresh token, so it must not be aborted once it has started
+	refreshCtx, refreshSpan := tracing.Tracer().Start(context.WithoutCancel(ctx), "Sweeper.refreshSession")
+	auth, err := s.client.RefreshSession(refreshCtx, configuration.Service, configuration.RefreshJwt)
+	tracing.EndSpan(refreshSpan, err)
+	if err != nil {
+		logger.Warn("Could not refresh session, disabling configuration and skipping", "err", err)
+
+		metrics.RefreshFailures.Inc()
+
+		if err := s.persister.DisableConfiguration(ctx, configuration.Did); err != nil {
+			logger.Error("Could not disable configuration, skipping", "err", err)
+		}
+
+		return 0, 0, false, fmt.Errorf("%w: %v", errCouldNotRefreshSession, err)
+	}
+
+	saveProgress := func(cursor string) error {
+		updateCtx, updateSpan := tracing.Tracer().Start(context.WithoutCancel(ctx), "Sweeper.updateRefreshTokenAndCursor")
+		err := s.persister.UpdateRefreshTokenAndCursor(
+			updateCtx,
+			auth.Did,
+			cursor,
+			auth.RefreshJwt,
+		)
+		tracing.EndSpan(updateSpan, err)
+
+		return err
+	}
+
+	// Listing and deleting are both paid from the DID's budget, so that accounts with large backlogs are swept over multiple sweeps
+	budget := bluesky.NewBudget(limiter, points)
+
+	postsBacklog := &backlog{}
+
+	saveStatistics := func(pending bool) {
+		postsPending := 0
+		if pending {
+			postsPending = postsBacklog.estimate(progress.PostsDeleted, time.Now().AddDate(0, -int(configuration.PostTtl), 0))
+
+			logger.Debug("Estimated backlog of DID", "posts_pending", postsPending)
+		}
+
+		if err := s.persister.UpdateSweepStatistics(context.WithoutCancel(ctx), configuration.Did, budget.GetSpendPoints(), pending, postsPending, progress.PostsDeleted, time.Now()); err != nil {
+			logger.Error("Could not update sweep statistics", "err", err)
+		}
+	}
+
+	committed, committedCursor := false, configuration.Cursor
+
+	sweepCtx, sweepPostsSpan := tracing.Tracer().Start(ctx, "Sweeper.sweepPosts")
+	deleted, err = s.client.SweepPosts(
+		sweepCtx,
+
+		configuration.Service,
+		auth,
+
+		int(configuration.PostTtl),
+		configuration.Cursor,
+		s.options.ListRecordsLimit, // Limit as per https://atproto.com/blog/rate-limits-pds-v3
+		points+1,                   // Every page costs at least one point, so the budget is always spent before this is reached
+		s.options.ApplyWritesLimit,
+
+		s.options.DryRun,
+
+		budget,
+
+		func(posts []bluesky.Record) {
+			progress.PostsTotal += len(posts)
+			postsBacklog.add(posts)
+
+			if hooks.OnPostsListed != nil {
+				hooks.OnPostsListed(configuration.Did, len(posts), progress)
+			}
+		},
+		func(batch []bluesky.Record) {
+			progress.PostsDeleted += len(batch)
+			progress.SpentPoints = limiter.GetSpendPoints()
+
+			if hooks.OnBatchDeleted != nil {
+				hooks.OnBatchDeleted(configuration.Did, len(batch), progress)
+			}
+		},
+		func(cursor string) error {
+			if err := saveProgress(cursor); err != nil {
+				return err
+			}
+
+			committed, committedCursor = true, cursor
+
+			return nil
+		},
+	)
+	sweepPostsSpan.SetAttributes(attribute.Int("posts", deleted))
+	tracing.EndSpan(sweepPostsSpan, err)
+
+	metrics.PostsDeleted.WithLabelValues(strconv.FormatBool(s.options.DryRun)).Add(float64(deleted))
+
+	// The budget is only exceeded if there were posts left to list or delete, not if it has been spent exactly on the last page
+	if errors.Is(err, bluesky.ErrBudgetExhausted) {
+		logger.Info("Spent budget of DID, continuing with the rest of its posts in the next sweep", "deleted", deleted, "spent_points", budget.GetSpendPoints())
+
+		pending, err = true, nil
+	}
+
+	if pending {
+		metrics.BudgetsExhausted.Inc()
+	}
+
+	if err != nil {
+		logger.Error("Could not sweep all posts, saving refresh token and progress and skipping", "deleted", deleted, "err", err)
+
+		// The refresh token has been rotated even if no page has been committed yet
+		if err := saveProgress(committedCursor); err != nil {
+			logger.Error("Could not update refresh token and cursor, skipping", "err", err)
+		}
+
+		saveStatistics(pending)
+
+		return progress.PostsTotal, deleted, pending, err
+	}
+
+	if !committed {
+		if err := saveProgress(committedCursor); err != nil {
+			logger.Error("Could not update refresh token, skipping", "err", err)
+
+			saveStatistics(pending)
+
+			return progress.PostsTotal, deleted, pending, fmt.Errorf("%w: %v", errCouldNotSaveProgress, err)
+		}
+	}
+
+	saveStatistics(pending)
+
+	return progress.PostsTotal, deleted, pending, nil
+}
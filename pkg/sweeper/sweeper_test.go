@@ -0,0 +1,378 @@
+package sweeper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/pojntfx/skysweeper/pkg/bluesky"
+	"github.com/pojntfx/skysweeper/pkg/models"
+)
+
+var (
+	errRevoked = errors.New("revoked")
+	errFailed  = errors.New("failed")
+	errDenied  = errors.New("denied")
+)
+
+type fakePersister struct {
+	configurations map[string]models.Configuration
+	serviceUpdates int
+}
+
+func newFakePersister(configurations ...models.Configuration) *fakePersister {
+	p := &fakePersister{
+		configurations: map[string]models.Configuration{},
+	}
+
+	for _, c := range configurations {
+		p.configurations[c.Did] = c
+	}
+
+	return p
+}
+
+func (p *fakePersister) GetConfiguration(ctx context.Context, did string) (models.Configuration, error) {
+	c, ok := p.configurations[did]
+	if !ok {
+		return models.Configuration{}, sql.ErrNoRows
+	}
+
+	return c, nil
+}
+
+func (p *fakePersister) GetEnabledConfigurations(ctx context.Context) ([]models.Configuration, error) {
+	configurations := []models.Configuration{}
+	for _, c := range p.configurations {
+		if c.Enabled {
+			configurations = append(configurations, c)
+		}
+	}
+
+	sort.Slice(configurations, func(i, j int) bool {
+		return configurations[i].Did < configurations[j].Did
+	})
+
+	return configurations, nil
+}
+
+func (p *fakePersister) DisableConfiguration(ctx context.Context, did string) error {
+	c := p.configurations[did]
+	c.Enabled = false
+	c.DisabledByFailure = true
+	p.configurations[did] = c
+
+	return nil
+}
+
+func (p *fakePersister) UpdateRefreshTokenAndCursor(ctx context.Context, did string, cursor string, refreshJWT string) error {
+	c := p.configurations[did]
+	c.Cursor = cursor
+	c.RefreshJwt = refreshJWT
+	p.configurations[did] = c
+
+	return nil
+}
+
+func (p *fakePersister) UpdateService(ctx context.Context, did string, service string) error {
+	c := p.configurations[did]
+	c.Service = service
+	p.configurations[did] = c
+	p.serviceUpdates++
+
+	return nil
+}
+
+func (p *fakePersister) UpdateSweepStatistics(ctx context.Context, did string, pointsSpent int, backlogPending bool, postsPending int, sweptPosts int, sweptAt time.Time) error {
+	c := p.configurations[did]
+	c.PointsSpent += int64(pointsSpent)
+	c.BacklogPending = backlogPending
+	c.PostsPending = int64(postsPending)
+	c.LastSweptPosts = int64(sweptPosts)
+	c.LastSweptAt = sql.NullTime{Time: sweptAt, Valid: true}
+	p.configurations[did] = c
+
+	return nil
+}
+
+// fakeClient deletes two posts per DID in one page, spending one point for listing and one per deleted post;
+// DIDs in fail stop after the first post
+type fakeClient struct {
+	services map[string]string
+	revoked  map[string]bool
+	fail     map[string]bool
+	denied   map[string]bool
+}
+
+func (c *fakeClient) ResolvePDS(ctx context.Context, did string) (string, error) {
+	return c.services[did], nil
+}
+
+func (c *fakeClient) ValidateService(ctx context.Context, service string) error {
+	if c.denied[service] {
+		return errDenied
+	}
+
+	return nil
+}
+
+func (c *fakeClient) RefreshSession(ctx context.Context, service string, refreshJWT string) (*xrpc.AuthInfo, error) {
+	did := refreshJWT[len("refresh-"):]
+	if c.revoked[did] {
+		return nil, errRevoked
+	}
+
+	return &xrpc.AuthInfo{
+		Did:        did,
+		RefreshJwt: "rotated-" + did,
+	}, nil
+}
+
+func (c *fakeClient) SweepPosts(
+	ctx context.Context,
+
+	service string,
+	auth *xrpc.AuthInfo,
+
+	postTTL int,
+	cursor string,
+	listBatchSize int,
+	limit int,
+	deleteBatchSize int,
+
+	dryRun bool,
+
+	limiter bluesky.Spender,
+
+	onPageListed func(posts []bluesky.Record),
+	onBatchDeleted func(batch []bluesky.Record),
+	commit func(cursor string) error,
+) (int, error) {
+	posts := []bluesky.Record{{DID: auth.Did, Rkey: "1"}, {DID: auth.Did, Rkey: "2"}}
+
+	if err := limiter.Spend(ctx, bluesky.PointsGet); err != nil {
+		return 0, err
+	}
+
+	onPageListed(posts)
+
+	for i := range posts {
+		if c.fail[auth.Did] && i > 0 {
+			return i, errFailed
+		}
+
+		if err := limiter.Spend(ctx, bluesky.PointsDelete); err != nil {
+			return i, err
+		}
+
+		onBatchDeleted(posts[i : i+1])
+	}
+
+	return len(posts), commit("2")
+}
+
+func TestSweeperSkipsFailedDIDsAndSavesRotatedRefreshTokens(t *testing.T) {
+	persister := newFakePersister(
+		models.Configuration{Did: "did:plc:alice", Service: "https://old.example", RefreshJwt: "refresh-did:plc:alice", Enabled: true, PostTtl: 1},
+		models.Configuration{Did: "did:plc:bob", Service: "https://pds.example", RefreshJwt: "refresh-did:plc:bob", Enabled: true, PostTtl: 1, Cursor: "0"},
+		models.Configuration{Did: "did:plc:carol", Service: "https://pds.example", RefreshJwt: "refresh-did:plc:carol", Enabled: true, PostTtl: 1},
+	)
+
+	client := &fakeClient{
+		services: map[string]string{
+			"did:plc:alice": "https://pds.example",
+			"did:plc:bob":   "https://pds.example",
+			"did:plc:carol": "https://pds.example",
+		},
+		revoked: map[string]bool{"did:plc:carol": true},
+		fail:    map[string]bool{"did:plc:bob": true},
+	}
+
+	s := NewSweeper(persister, client, Options{
+		RateLimitPointsGlobal:  100,
+		RateLimitResetInterval: time.Minute,
+		RateLimitPointsDID:     10,
+		ListRecordsLimit:       100,
+		ApplyWritesLimit:       10,
+	})
+
+	finished := map[string]error{}
+	result, err := s.Sweep(context.Background(), "", Hooks{
+		OnDIDFinished: func(did string, progress Progress, err error) {
+			finished[did] = err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.DIDs != 3 || result.DIDsFailed != 2 || result.PostsListed != 4 || result.PostsDeleted != 3 {
+		t.Fatalf("got result %+v, want 3 DIDs of which 2 failed with 4 posts listed and 3 deleted", result)
+	}
+
+	if finished["did:plc:alice"] != nil || finished["did:plc:bob"] == nil || finished["did:plc:carol"] == nil {
+		t.Fatalf("got finished DIDs %v, want only alice to succeed", finished)
+	}
+
+	if alice := persister.configurations["did:plc:alice"]; alice.Service != "https://pds.example" || alice.Cursor != "2" || alice.RefreshJwt != "rotated-did:plc:alice" {
+		t.Fatalf("got alice %+v, want the moved service, the committed cursor and the rotated refresh token", alice)
+	}
+
+	// The refresh token has been rotated before the failure, so it must have been saved with the old cursor
+	if bob := persister.configurations["did:plc:bob"]; bob.Cursor != "0" || bob.RefreshJwt != "rotated-did:plc:bob" {
+		t.Fatalf("got bob %+v, want the previous cursor and the rotated refresh token", bob)
+	}
+
+	if carol := persister.configurations["did:plc:carol"]; carol.Enabled || !carol.DisabledByFailure {
+		t.Fatalf("got carol %+v, want configuration to be disabled by failure", carol)
+	}
+}
+
+func TestSweeperOnlySweepsEnabledConfigurationOfDID(t *testing.T) {
+	persister := newFakePersister(
+		models.Configuration{Did: "did:plc:alice", RefreshJwt: "refresh-did:plc:alice", Enabled: true, PostTtl: 1},
+		models.Configuration{Did: "did:plc:bob", RefreshJwt: "refresh-did:plc:bob", PostTtl: 1},
+	)
+
+	s := NewSweeper(persister, &fakeClient{}, Options{
+		RateLimitPointsGlobal:  100,
+		RateLimitResetInterval: time.Minute,
+	})
+
+	for did, want := range map[string]int{
+		"did:plc:alice":   1,
+		"did:plc:bob":     0,
+		"did:plc:missing": 0,
+	} {
+		result, err := s.Sweep(context.Background(), did, Hooks{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.DIDs != want {
+			t.Fatalf("got %v swept DIDs for %v, want %v", result.DIDs, did, want)
+		}
+	}
+}
+
+func TestSweeperSharesBudgetOfSweepByPriority(t *testing.T) {
+	persister := newFakePersister(
+		models.Configuration{Did: "did:plc:alice", RefreshJwt: "refresh-did:plc:alice", Enabled: true, PostTtl: 1},
+		models.Configuration{Did: "did:plc:bob", RefreshJwt: "refresh-did:plc:bob", Enabled: true, PostTtl: 1, LastSweptAt: sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}},
+		models.Configuration{Did: "did:plc:carol", RefreshJwt: "refresh-did:plc:carol", Enabled: true, PostTtl: 1, BacklogPending: true, LastSweptAt: sql.NullTime{Time: time.Now(), Valid: true}},
+	)
+
+	s := NewSweeper(persister, &fakeClient{}, Options{
+		RateLimitPointsGlobal:  100,
+		RateLimitResetInterval: time.Minute,
+		RateLimitPointsDID:     10,
+		RateLimitPointsSweep:   4,
+	})
+
+	started := []string{}
+	result, err := s.Sweep(context.Background(), "", Hooks{
+		OnDIDStarted: func(did string) {
+			started = append(started, did)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending backlog comes first, followed by DIDs which have never been swept
+	if want := []string{"did:plc:carol", "did:plc:alice", "did:plc:bob"}; strings.Join(started, ",") != strings.Join(want, ",") {
+		t.Fatalf("got DIDs swept in order %v, want %v", started, want)
+	}
+
+	// Every swept DID gets enough points to delete at least one post, so that it makes progress
+	if result.DIDsFailed != 0 || result.DIDsPending != 2 || result.DIDsDeferred != 1 || result.PostsDeleted != 2 {
+		t.Fatalf("got result %+v, want 2 DIDs with one deleted and one pending post each and 1 deferred DID", result)
+	}
+
+	for _, did := range []string{"did:plc:carol", "did:plc:alice"} {
+		if c := persister.configurations[did]; c.PointsSpent != 2 || !c.BacklogPending || !c.LastSweptAt.Valid {
+			t.Fatalf("got %v %+v, want two spent points and a pending backlog", did, c)
+		}
+	}
+
+	if bob := persister.configurations["did:plc:bob"]; bob.PointsSpent != 0 || bob.BacklogPending {
+		t.Fatalf("got bob %+v, want deferred DID to be left untouched", bob)
+	}
+}
+
+func TestSweeperDoesNotSendRefreshTokensToDeniedServices(t *testing.T) {
+	persister := newFakePersister(
+		models.Configuration{Did: "did:plc:alice", Service: "https://pds.example", RefreshJwt: "refresh-did:plc:alice", Enabled: true, PostTtl: 1},
+		models.Configuration{Did: "did:plc:bob", Service: "https://private.example", RefreshJwt: "refresh-did:plc:bob", Enabled: true, PostTtl: 1},
+	)
+
+	client := &fakeClient{
+		services: map[string]string{
+			"did:plc:alice": "https://private.example", // The DID document of alice points to a denied service
+			"did:plc:bob":   "https://private.example",
+		},
+		denied: map[string]bool{"https://private.example": true},
+	}
+
+	s := NewSweeper(persister, client, Options{
+		RateLimitPointsGlobal:  100,
+		RateLimitResetInterval: time.Minute,
+		RateLimitPointsDID:     10,
+	})
+
+	finished := map[string]error{}
+	if _, err := s.Sweep(context.Background(), "", Hooks{
+		OnDIDFinished: func(did string, progress Progress, err error) {
+			finished[did] = err
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if alice := persister.configurations["did:plc:alice"]; finished["did:plc:alice"] != nil || alice.Service != "https://pds.example" {
+		t.Fatalf("got alice %+v and error %v, want her to be swept with the stored service", alice, finished["did:plc:alice"])
+	}
+
+	if bob := persister.configurations["did:plc:bob"]; !errors.Is(finished["did:plc:bob"], errServiceNotAllowed) || bob.RefreshJwt != "refresh-did:plc:bob" || !bob.Enabled {
+		t.Fatalf("got bob %+v and error %v, want him to be skipped without refreshing or disabling him", bob, finished["did:plc:bob"])
+	}
+}
+
+func TestSweeperDoesNotMarkBacklogPendingIfBudgetIsSpentOnLastPage(t *testing.T) {
+	persister := newFakePersister(
+		models.Configuration{Did: "did:plc:alice", Service: "https://PDS.example/", RefreshJwt: "refresh-did:plc:alice", Enabled: true, PostTtl: 1, BacklogPending: true},
+	)
+
+	client := &fakeClient{
+		services: map[string]string{"did:plc:alice": "https://pds.example"},
+	}
+
+	// Listing and deleting both posts costs exactly the budget of the DID
+	s := NewSweeper(persister, client, Options{
+		RateLimitPointsGlobal:  100,
+		RateLimitResetInterval: time.Minute,
+		RateLimitPointsDID:     3,
+	})
+
+	result, err := s.Sweep(context.Background(), "", Hooks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.DIDsPending != 0 || result.PostsDeleted != 2 {
+		t.Fatalf("got result %+v, want both posts to be deleted without a pending DID", result)
+	}
+
+	if alice := persister.configurations["did:plc:alice"]; alice.BacklogPending || alice.PostsPending != 0 || alice.PointsSpent != 3 {
+		t.Fatalf("got alice %+v, want no pending backlog after spending three points", alice)
+	}
+
+	if persister.serviceUpdates != 0 {
+		t.Fatalf("got %v service updates, want the equal service to be kept", persister.serviceUpdates)
+	}
+}